@@ -0,0 +1,97 @@
+package ratelimiter
+
+import "time"
+
+// Algorithm selects how a Limiter decides whether work can proceed.
+type Algorithm int
+
+const (
+	// TokenBucket refills a bucket of tokens at a steady rate and lets callers
+	// spend them as fast as they like. It allows bursts of up to the bucket's
+	// capacity. This is the default.
+	TokenBucket Algorithm = iota
+
+	// SlidingWindow remembers when each unit of work happened and allows no
+	// more than rate of them in any window length period. It is stricter
+	// than TokenBucket, which can let through more than rate units of work
+	// in a window straddling a burst. WithBurst has no effect and Reserve is
+	// not supported.
+	SlidingWindow
+
+	// LeakyBucket spaces units of work evenly, at least window/rate apart, no
+	// matter how long the limiter has been idle. Blocked callers are served in
+	// FIFO order. Because it never accumulates credit AcquireN can only
+	// acquire one token at a time and WithBurst has no effect.
+	LeakyBucket
+)
+
+// WithAlgorithm sets the rate limiting algorithm. The default is TokenBucket.
+func WithAlgorithm(a Algorithm) Option {
+	return func(l *Limiter) {
+		l.algorithm = a
+	}
+}
+
+// slidingLog is a ring buffer of the times that units of work happened, oldest
+// first, used by the SlidingWindow algorithm.
+type slidingLog struct {
+	times  []time.Time
+	start  int // index of the oldest entry
+	count  int
+	window time.Duration
+}
+
+func newSlidingLog(size int, window time.Duration) *slidingLog {
+	return &slidingLog{
+		times:  make([]time.Time, size),
+		window: window,
+	}
+}
+
+// resize changes the capacity and window of the log, keeping the newest
+// entries if it shrinks.
+func (sl *slidingLog) resize(size int, window time.Duration) {
+	times := make([]time.Time, size)
+	keep := min(sl.count, size)
+	for i := range keep {
+		times[i] = sl.at(sl.count - keep + i)
+	}
+	sl.times = times
+	sl.start = 0
+	sl.count = keep
+	sl.window = window
+}
+
+// at returns the i'th oldest entry.
+func (sl *slidingLog) at(i int) time.Time {
+	return sl.times[(sl.start+i)%len(sl.times)]
+}
+
+// evict discards entries that have aged out of the window.
+func (sl *slidingLog) evict(now time.Time) {
+	for sl.count > 0 && now.Sub(sl.at(0)) >= sl.window {
+		sl.start = (sl.start + 1) % len(sl.times)
+		sl.count--
+	}
+}
+
+// add records n units of work at now. The caller must ensure there is room.
+func (sl *slidingLog) add(now time.Time, n int) {
+	for range n {
+		sl.times[(sl.start+sl.count)%len(sl.times)] = now
+		sl.count++
+	}
+}
+
+// timeUntil returns how long until need more entries will have aged out.
+func (sl *slidingLog) timeUntil(now time.Time, need int) time.Duration {
+	if need <= 0 {
+		return 0
+	}
+	return sl.at(need - 1).Add(sl.window).Sub(now)
+}
+
+// remove discards the n newest entries, for work that didn't happen after all.
+func (sl *slidingLog) remove(n int) {
+	sl.count -= min(n, sl.count)
+}
@@ -0,0 +1,113 @@
+package ratelimiter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSlidingWindowVersusTokenBucket(t *testing.T) {
+	// Send a burst at the start, then a request every 250ms for two seconds,
+	// counting how many get through with each algorithm.
+	run := func(a Algorithm) []int {
+		fakeclock := newFakeClock(time.Now())
+		l := New(4, time.Second, WithAlgorithm(a), WithClock(fakeclock))
+
+		var granted []int
+		for range 4 {
+			if l.TryAcquire() {
+				granted = append(granted, 0)
+			}
+		}
+		for i := 1; i <= 8; i++ {
+			fakeclock.Advance(250 * time.Millisecond)
+			for range 2 {
+				if l.TryAcquire() {
+					granted = append(granted, i*250)
+				}
+			}
+		}
+		return granted
+	}
+
+	// Token bucket refills steadily so requests are granted as soon as a
+	// token has accrued, on top of the initial burst.
+	tb := run(TokenBucket)
+	if got := countWithin(tb, 0, 999); got != 7 {
+		t.Errorf("Expected token bucket to allow 7 requests in [0ms, 999ms], got %d - %v", got, tb)
+	}
+
+	// Sliding window never allows more than 4 in any second.
+	sw := run(SlidingWindow)
+	for start := 0; start <= 1000; start += 250 {
+		if got := countWithin(sw, start, start+999); got > 4 {
+			t.Errorf("Sliding window allowed %d requests in [%dms, %dms] - %v", got, start, start+999, sw)
+		}
+	}
+	if len(sw) != 10 {
+		t.Errorf("Expected sliding window to grant 10 requests, got %d - %v", len(sw), sw)
+	}
+}
+
+func TestSlidingWindowAcquire(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	l := New(2, time.Second, WithAlgorithm(SlidingWindow), WithClock(fakeclock))
+	start := fakeclock.Now()
+	if err := l.AcquireN(t.Context(), 2); err != nil {
+		t.Fatalf("Unexpected error on AcquireN() - %s", err)
+	}
+	fakeclock.Advance(100 * time.Millisecond)
+	if got := l.Tokens(); got != 0 {
+		t.Errorf("Expected no tokens available, got %d", got)
+	}
+
+	// The slot doesn't free up until the first entry ages out of the window
+	if err := l.Acquire(t.Context()); err != nil {
+		t.Fatalf("Unexpected error on Acquire() - %s", err)
+	}
+	if elapsed := fakeclock.Now().Sub(start); elapsed < time.Second {
+		t.Errorf("Expected Acquire() to wait for the window to pass, only %s elapsed", elapsed)
+	}
+	if _, ok := l.Reserve(); ok {
+		t.Errorf("Reserve() is not supported with a sliding window")
+	}
+}
+
+// countWithin returns how many of times (in ms) fall within [from, to].
+func countWithin(times []int, from, to int) int {
+	var n int
+	for _, tm := range times {
+		if tm >= from && tm <= to {
+			n++
+		}
+	}
+	return n
+}
+
+func TestLeakyBucket(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	const interval = time.Second / 5
+	l := New(5, time.Second, WithAlgorithm(LeakyBucket), WithClock(fakeclock))
+
+	// Even after a long idle period only a single request can go straight
+	// through.
+	fakeclock.Advance(time.Hour)
+	var last time.Time
+	for i := range 4 {
+		if err := l.Acquire(t.Context()); err != nil {
+			t.Fatalf("Unexpected error on Acquire() - %s", err)
+		}
+		now := fakeclock.Now()
+		if i > 0 {
+			if gap := now.Sub(last); gap < interval {
+				t.Errorf("Acquire() %d was only %s after the previous one, want at least %s", i, gap, interval)
+			}
+		}
+		last = now
+	}
+
+	if l.TryAcquire() {
+		t.Errorf("TryAcquire() should not succeed immediately after an Acquire()")
+	}
+}
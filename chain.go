@@ -0,0 +1,112 @@
+package ratelimiter
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// A ChainLimiter only lets work proceed once every one of its limiters has, for
+// example a limiter for the service's overall capacity followed by one per
+// client. Create one with Chain.
+type ChainLimiter struct {
+	limiters []*Limiter
+}
+
+// Chain returns a ChainLimiter that acquires from limiters in the order given.
+func Chain(limiters ...*Limiter) *ChainLimiter {
+	return &ChainLimiter{limiters: limiters}
+}
+
+// A Tier is one of the limits of a tiered limiter, rate tokens per window.
+type Tier struct {
+	Rate   int
+	Window time.Duration
+}
+
+// NewTiered returns a ChainLimiter enforcing every one of tiers at once, each
+// with its own bucket, e.g. 100 a minute and 1000 an hour so that the hourly
+// budget can't be used up in ten minutes. Work proceeds only once a token has
+// been taken from every tier, and if any of them would block past the deadline
+// the others are given their tokens back. The options are applied to each
+// tier's limiter, as by New.
+func NewTiered(tiers []Tier, opts ...Option) *ChainLimiter {
+	limiters := make([]*Limiter, len(tiers))
+	for i, t := range tiers {
+		limiters[i] = New(t.Rate, t.Window, opts...)
+	}
+	return Chain(limiters...)
+}
+
+// Acquire acquires from each limiter in turn, blocking as Limiter.Acquire does
+// and charging each the cost it gives the work. If any of them fails, such as
+// when ctx is done or the wait would go past its deadline, the tokens already
+// taken from earlier limiters are returned and the error from the failing
+// limiter is returned.
+func (c *ChainLimiter) Acquire(ctx context.Context) error {
+	taken := make([]int, 0, len(c.limiters))
+	for _, l := range c.limiters {
+		n, err := l.acquireCharged(ctx)
+		if err != nil {
+			c.refund(taken)
+			return err
+		}
+		taken = append(taken, n)
+	}
+	return nil
+}
+
+// TryAcquire takes a token from every limiter without blocking. It returns
+// false, leaving all the limiters as they were, if any of them is empty.
+func (c *ChainLimiter) TryAcquire() bool {
+	taken := make([]int, 0, len(c.limiters))
+	for _, l := range c.limiters {
+		if !l.TryAcquire() {
+			c.refund(taken)
+			return false
+		}
+		taken = append(taken, 1)
+	}
+	return true
+}
+
+// refund gives back the tokens taken from each of the first len(taken)
+// limiters, latest first.
+func (c *ChainLimiter) refund(taken []int) {
+	for i := len(taken) - 1; i >= 0; i-- {
+		c.limiters[i].refund(taken[i])
+	}
+}
+
+// refund puts n tokens that were taken, but not used, back in the bucket. The
+// bucket can't be refilled beyond its burst.
+func (l *Limiter) refund(n int) {
+	l.lock()
+	defer l.unlock()
+
+	l.refill()
+	if l.log != nil {
+		l.log.remove(n)
+		l.tokens = l.rate - l.log.count
+		return
+	}
+	l.tokens = min(l.tokens+n, l.burst)
+}
+
+// nextID hands out limiter ids.
+var nextID atomic.Uint64
+
+// AcquireAll acquires a token from every one of limiters, e.g. layered burst,
+// sustained and daily limits, returning once they have all been granted. The
+// limiters are always acquired from in the same order, whatever order they are
+// passed in, so that callers sharing limiters don't hold tokens from some
+// while waiting on each other for the rest. As with ChainLimiter, if any of
+// them fails the tokens already taken are returned.
+func AcquireAll(ctx context.Context, limiters ...*Limiter) error {
+	sorted := slices.SortedFunc(slices.Values(limiters), func(a, b *Limiter) int {
+		return cmp.Compare(a.id, b.id)
+	})
+	return Chain(sorted...).Acquire(ctx)
+}
@@ -0,0 +1,202 @@
+package ratelimiter
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestChain(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	global := New(10, time.Minute, WithClock(fakeclock))
+	perKey := New(2, time.Minute, WithClock(fakeclock), WithAlgorithm(SlidingWindow))
+	c := Chain(global, perKey)
+
+	for range 2 {
+		if err := c.Acquire(t.Context()); err != nil {
+			t.Fatalf("Unexpected error on Acquire() - %s", err)
+		}
+	}
+	if got := global.Tokens(); got != 8 {
+		t.Errorf("Expected the global limiter to have 8 tokens, has %d", got)
+	}
+
+	// The per-key limiter is empty, so the global token must be given back
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second)
+	defer cancel()
+	if err := c.Acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded from the empty limiter, got %v", err)
+	}
+	if got := global.Tokens(); got != 8 {
+		t.Errorf("Expected the global limiter's token to be returned, has %d", got)
+	}
+	if c.TryAcquire() {
+		t.Errorf("TryAcquire() should fail when a limiter is empty")
+	}
+	if got := global.Tokens(); got != 8 {
+		t.Errorf("Expected TryAcquire() to return the global limiter's token, has %d", got)
+	}
+
+	// A global limiter with nothing left fails before touching the per-key one
+	fakeclock.Advance(time.Minute)
+	global.Drain()
+	if c.TryAcquire() {
+		t.Errorf("TryAcquire() should fail when the first limiter is empty")
+	}
+	if got := perKey.Tokens(); got != 2 {
+		t.Errorf("Expected the per-key limiter to be untouched, has %d", got)
+	}
+}
+
+func TestChainRefundsCost(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	first := New(10, time.Minute, WithClock(fakeclock))
+	second := New(10, time.Minute, WithClock(fakeclock))
+	second.Drain()
+	c := Chain(first, second)
+
+	// The second limiter is empty so the first must get back all 5 tokens
+	ctx, cancel := context.WithTimeout(WithCost(t.Context(), 5), time.Second)
+	defer cancel()
+	if err := c.Acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded from the empty limiter, got %v", err)
+	}
+	if got := first.Tokens(); got != 10 {
+		t.Errorf("Expected the first limiter to get its 5 tokens back, has %d", got)
+	}
+}
+
+func TestChainRefundsCostFunc(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	cost := func(ctx context.Context) int { return 3 }
+	first := New(10, time.Minute, WithCostFunc(cost), WithClock(fakeclock))
+	second := New(10, time.Minute, WithClock(fakeclock))
+	second.Drain()
+	c := Chain(first, second)
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second)
+	defer cancel()
+	if err := c.Acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded from the empty limiter, got %v", err)
+	}
+	if got := first.Tokens(); got != 10 {
+		t.Errorf("Expected the first limiter to get its 3 tokens back, has %d", got)
+	}
+
+	// Once the second has a token each is charged its own cost
+	fakeclock.Advance(6 * time.Second)
+	if err := c.Acquire(t.Context()); err != nil {
+		t.Fatalf("Unexpected error on Acquire() - %s", err)
+	}
+	if got := first.Tokens(); got != 7 {
+		t.Errorf("Expected the first limiter to charge 3 tokens, has %d", got)
+	}
+	if got := second.Tokens(); got != 0 {
+		t.Errorf("Expected the second limiter to charge 1 token, has %d", got)
+	}
+}
+
+func TestNewTiered(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	c := NewTiered([]Tier{
+		{Rate: 10, Window: time.Minute},
+		{Rate: 15, Window: time.Hour},
+	}, WithClock(fakeclock))
+	minute, hour := c.limiters[0], c.limiters[1]
+
+	for range 10 {
+		if !c.TryAcquire() {
+			t.Fatalf("TryAcquire() should succeed within both tiers")
+		}
+	}
+	if c.TryAcquire() {
+		t.Errorf("TryAcquire() should fail once the per-minute tier is empty")
+	}
+
+	// A minute later the per-minute tier has refilled but only 5 of the hour's
+	// tokens are left.
+	fakeclock.Advance(time.Minute)
+	for range 5 {
+		if err := c.Acquire(t.Context()); err != nil {
+			t.Fatalf("Unexpected error on Acquire() - %s", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+	defer cancel()
+	if err := c.Acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the hourly tier to bind with context.DeadlineExceeded, got %v", err)
+	}
+	if got := minute.Tokens(); got != 5 {
+		t.Errorf("Expected the per-minute tier to get its token back, has %d", got)
+	}
+	if got := hour.Tokens(); got != 0 {
+		t.Errorf("Expected the hourly tier to be empty, has %d", got)
+	}
+}
+
+func TestRefund(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	// Refunds can't overfill the bucket
+	l := New(5, time.Minute, WithClock(fakeclock))
+	l.AcquireUpTo(2)
+	l.refund(4)
+	if got := l.Tokens(); got != 5 {
+		t.Errorf("Expected the refund to be capped at the burst, has %d", got)
+	}
+
+	// A sliding window forgets the refunded work
+	l = New(5, time.Minute, WithClock(fakeclock), WithAlgorithm(SlidingWindow))
+	l.AcquireUpTo(3)
+	l.refund(1)
+	if got := l.Tokens(); got != 3 {
+		t.Errorf("Expected a sliding window with 3 tokens, has %d", got)
+	}
+}
+
+func TestAcquireAll(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	burst := New(5, time.Second, WithClock(fakeclock))
+	sustained := New(10, time.Minute, WithClock(fakeclock))
+	daily := New(2, 24*time.Hour, WithClock(fakeclock))
+
+	// Passed in any order, they're acquired in the same order
+	for _, limiters := range [][]*Limiter{
+		{burst, sustained, daily},
+		{daily, burst, sustained},
+	} {
+		if err := AcquireAll(t.Context(), limiters...); err != nil {
+			t.Fatalf("Unexpected error on AcquireAll() - %s", err)
+		}
+	}
+	for _, tc := range []struct {
+		l    *Limiter
+		want int
+	}{
+		{burst, 3}, {sustained, 8}, {daily, 0},
+	} {
+		if got := tc.l.Tokens(); got != tc.want {
+			t.Errorf("Expected %s to have %d tokens, has %d", tc.l, tc.want, got)
+		}
+	}
+
+	// The daily cap is used up, so the tokens taken from the others before
+	// giving up are returned.
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second)
+	defer cancel()
+	if err := AcquireAll(ctx, daily, sustained, burst); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded from the daily limit, got %v", err)
+	}
+	if got := burst.Tokens(); got != 3 {
+		t.Errorf("Expected the burst limiter's token to be returned, has %d", got)
+	}
+	if got := sustained.Tokens(); got != 8 {
+		t.Errorf("Expected the sustained limiter's token to be returned, has %d", got)
+	}
+}
@@ -0,0 +1,51 @@
+package ratelimiter_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chriskillpack/ratelimiter"
+)
+
+// manualClock is a Clock whose time only moves when told to. After returns
+// immediately having advanced the clock, so blocking in the limiter never
+// actually sleeps.
+type manualClock struct {
+	now    time.Time
+	waited time.Duration
+}
+
+func (mc *manualClock) Now() time.Time {
+	return mc.now
+}
+
+func (mc *manualClock) After(d time.Duration) <-chan time.Time {
+	mc.now = mc.now.Add(d)
+	mc.waited += d
+
+	c := make(chan time.Time, 1)
+	c <- mc.now
+	return c
+}
+
+func TestWithClock(t *testing.T) {
+	mc := &manualClock{now: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	l := ratelimiter.New(2, time.Second, ratelimiter.WithClock(mc))
+
+	for range 2 {
+		if err := l.Acquire(t.Context()); err != nil {
+			t.Fatalf("Unexpected error on Acquire() - %s", err)
+		}
+	}
+	if mc.waited != 0 {
+		t.Errorf("The limiter should not have blocked but waited %s", mc.waited)
+	}
+
+	// The bucket is empty so the next Acquire has to wait for a token.
+	if err := l.Acquire(t.Context()); err != nil {
+		t.Fatalf("Unexpected error on Acquire() - %s", err)
+	}
+	if want := 500 * time.Millisecond; mc.waited != want {
+		t.Errorf("Expected the limiter to wait %s, waited %s", want, mc.waited)
+	}
+}
@@ -0,0 +1,62 @@
+package ratelimiter
+
+import (
+	"context"
+	"sync"
+)
+
+// A ConcurrencyLimiter caps how many units of work can be in progress at once,
+// rather than how often they can start. It is a companion to Limiter for work
+// that needs both, e.g. requests to a backend that copes with at most so many
+// in flight.
+type ConcurrencyLimiter struct {
+	slots chan struct{}
+}
+
+// NewConcurrencyLimiter creates a limiter allowing at most n units of work in
+// progress at once.
+func NewConcurrencyLimiter(n int) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{slots: make(chan struct{}, n)}
+}
+
+// Acquire blocks until there is a free slot, or ctx is done. On success it
+// returns a function that must be called to give the slot back once the work
+// has finished. Calling it more than once has no effect. The error is ctx.Err()
+// if ctx is done before a slot is free.
+func (c *ConcurrencyLimiter) Acquire(ctx context.Context) (release func(), err error) {
+	select {
+	case c.slots <- struct{}{}:
+		return c.releaser(), nil
+	default:
+	}
+
+	select {
+	case c.slots <- struct{}{}:
+		return c.releaser(), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// TryAcquire takes a slot if one is free without blocking. It reports false,
+// and a nil release function, if not.
+func (c *ConcurrencyLimiter) TryAcquire() (release func(), ok bool) {
+	select {
+	case c.slots <- struct{}{}:
+		return c.releaser(), true
+	default:
+		return nil, false
+	}
+}
+
+// InFlight returns how many slots are currently taken.
+func (c *ConcurrencyLimiter) InFlight() int {
+	return len(c.slots)
+}
+
+func (c *ConcurrencyLimiter) releaser() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() { <-c.slots })
+	}
+}
@@ -0,0 +1,70 @@
+package ratelimiter
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimiter(t *testing.T) {
+	const n = 3
+	c := NewConcurrencyLimiter(n)
+
+	var releases []func()
+	for range n {
+		release, err := c.Acquire(t.Context())
+		if err != nil {
+			t.Fatalf("Unexpected error on Acquire() - %s", err)
+		}
+		releases = append(releases, release)
+	}
+	if got := c.InFlight(); got != n {
+		t.Errorf("Expected %d in flight, got %d", n, got)
+	}
+	if _, ok := c.TryAcquire(); ok {
+		t.Errorf("TryAcquire() should fail with every slot taken")
+	}
+
+	// The next caller blocks until a slot is released
+	acquired := make(chan func())
+	go func() {
+		release, err := c.Acquire(t.Context())
+		if err != nil {
+			t.Errorf("Unexpected error on Acquire() - %s", err)
+		}
+		acquired <- release
+	}()
+	select {
+	case <-acquired:
+		t.Fatalf("Acquire() should block with every slot taken")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// Releasing twice only frees one slot
+	releases[0]()
+	releases[0]()
+	release := <-acquired
+	if got := c.InFlight(); got != n {
+		t.Errorf("Expected %d in flight after the handover, got %d", n, got)
+	}
+	release()
+	if got := c.InFlight(); got != n-1 {
+		t.Errorf("Expected %d in flight after releasing, got %d", n-1, got)
+	}
+}
+
+func TestConcurrencyLimiterContext(t *testing.T) {
+	c := NewConcurrencyLimiter(1)
+	release, ok := c.TryAcquire()
+	if !ok {
+		t.Fatalf("TryAcquire() should succeed on an idle limiter")
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(t.Context(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.Acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+}
@@ -0,0 +1,63 @@
+package ratelimiter
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// config is the JSON form of a limiter's configuration.
+type config struct {
+	Rate   int    `json:"rate"`
+	Window string `json:"window"`
+	Burst  int    `json:"burst,omitempty"`
+}
+
+// errInUse is returned by UnmarshalJSON for a limiter that's already set up.
+var errInUse = errors.New("ratelimiter: can't unmarshal into a limiter in use")
+
+// MarshalJSON encodes the limiter's configuration, not the state of its bucket,
+// e.g. {"rate":10,"window":"1m0s"}. The burst is only included if it was set
+// with WithBurst, and leaves out any boost. Snapshot captures the state.
+func (l *Limiter) MarshalJSON() ([]byte, error) {
+	l.lock()
+	defer l.unlock()
+
+	c := config{Rate: l.rate, Window: l.window.String()}
+	if l.fixedBurst {
+		c.Burst = l.burst - l.boost
+	}
+	return json.Marshal(c)
+}
+
+// UnmarshalJSON sets up a Limiter from the configuration written by
+// MarshalJSON, as if by New with a full bucket and the default options. It is
+// meant for creating limiters from config files and so must be used on a zero
+// Limiter, e.g. a field in a config struct, not one that is already in use.
+// The rate and window must be positive, as with NewChecked.
+func (l *Limiter) UnmarshalJSON(data []byte) error {
+	var c config
+	if err := json.Unmarshal(data, &c); err != nil {
+		return err
+	}
+	if l.done != nil {
+		return errInUse
+	}
+	window, err := time.ParseDuration(c.Window)
+	if err != nil {
+		return err
+	}
+	if c.Rate <= 0 {
+		return ErrInvalidRate
+	}
+	if window <= 0 {
+		return ErrInvalidWindow
+	}
+
+	var opts []Option
+	if c.Burst > 0 {
+		opts = append(opts, WithBurst(c.Burst))
+	}
+	l.init(c.Rate, window, opts...)
+	return nil
+}
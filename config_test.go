@@ -0,0 +1,92 @@
+package ratelimiter
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMarshalJSON(t *testing.T) {
+	for _, tc := range []struct {
+		l    *Limiter
+		want string
+	}{
+		{New(10, time.Minute), `{"rate":10,"window":"1m0s"}`},
+		{New(5, 500*time.Millisecond, WithBurst(20)), `{"rate":5,"window":"500ms","burst":20}`},
+	} {
+		got, err := json.Marshal(tc.l)
+		if err != nil {
+			t.Fatalf("Unexpected error on Marshal() - %s", err)
+		}
+		if string(got) != tc.want {
+			t.Errorf("Expected %s, got %s", tc.want, got)
+		}
+	}
+}
+
+func TestUnmarshalJSON(t *testing.T) {
+	var cfg struct {
+		API    Limiter  `json:"api"`
+		Search *Limiter `json:"search"`
+	}
+	blob := `{"api": {"rate": 3, "window": "1s"}, "search": {"rate": 1, "window": "1m0s", "burst": 2}}`
+	if err := json.Unmarshal([]byte(blob), &cfg); err != nil {
+		t.Fatalf("Unexpected error on Unmarshal() - %s", err)
+	}
+
+	if got := cfg.API.Rate(); got != 3 {
+		t.Errorf("Expected a rate of 3, got %d", got)
+	}
+	if got := cfg.API.Window(); got != time.Second {
+		t.Errorf("Expected a window of 1s, got %s", got)
+	}
+	for range 3 {
+		if err := cfg.API.Acquire(t.Context()); err != nil {
+			t.Fatalf("Unexpected error on Acquire() - %s", err)
+		}
+	}
+	if cfg.API.TryAcquire() {
+		t.Errorf("Expected the unmarshaled limiter to be empty after 3 acquires")
+	}
+	if got := cfg.Search.Tokens(); got != 2 {
+		t.Errorf("Expected a bucket filled to the burst of 2, has %d", got)
+	}
+
+	// Round trip
+	data, err := json.Marshal(cfg.Search)
+	if err != nil {
+		t.Fatalf("Unexpected error on Marshal() - %s", err)
+	}
+	var l Limiter
+	if err := json.Unmarshal(data, &l); err != nil {
+		t.Fatalf("Unexpected error on Unmarshal() - %s", err)
+	}
+	if l.Rate() != 1 || l.Window() != time.Minute || l.burst != 2 {
+		t.Errorf("Round trip gave %s with a burst of %d", &l, l.burst)
+	}
+}
+
+func TestUnmarshalJSONErrors(t *testing.T) {
+	for _, tc := range []struct {
+		blob string
+		want error
+	}{
+		{`{"rate": 0, "window": "1s"}`, ErrInvalidRate},
+		{`{"rate": 1, "window": "-1s"}`, ErrInvalidWindow},
+		{`{"rate": 1}`, nil}, // unparseable window
+	} {
+		var l Limiter
+		err := json.Unmarshal([]byte(tc.blob), &l)
+		if err == nil {
+			t.Errorf("Expected an error unmarshaling %s", tc.blob)
+		} else if tc.want != nil && !errors.Is(err, tc.want) {
+			t.Errorf("Expected %v unmarshaling %s, got %v", tc.want, tc.blob, err)
+		}
+	}
+
+	// A limiter that's being used can't be reconfigured this way
+	if err := json.Unmarshal([]byte(`{"rate": 1, "window": "1s"}`), New(1, time.Second)); !errors.Is(err, errInUse) {
+		t.Errorf("Expected errInUse, got %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+package ratelimiter
+
+import (
+	"context"
+	"slices"
+	"time"
+)
+
+// Fairness controls the order in which blocked callers are granted tokens.
+type Fairness int
+
+const (
+	// Unordered lets whichever blocked caller happens to wake first take the
+	// next token. This is the default and is the cheapest, but a caller that
+	// arrives late can jump ahead of one that has been waiting for a while.
+	Unordered Fairness = iota
+
+	// FIFO grants tokens in the order that callers arrived.
+	FIFO
+)
+
+// WithFairness sets the order in which blocked callers are granted tokens.
+func WithFairness(f Fairness) Option {
+	return func(l *Limiter) {
+		l.fairness = f
+	}
+}
+
+// WithPriorityAging sets how quickly callers waiting in AcquirePriority gain
+// priority, so that low priority callers are not starved by a steady stream of
+// high priority ones. The priority of a waiting caller goes up by one for each
+// d that it has waited. The default is the limiter's window, zero disables
+// aging.
+func WithPriorityAging(d time.Duration) Option {
+	return func(l *Limiter) {
+		l.aging = d
+		l.agingSet = true
+	}
+}
+
+// AcquirePriority is like Acquire but when the bucket is contended callers
+// with a higher prio are granted tokens first. Callers with the same priority
+// are served in the order they arrived. Callers waiting in Acquire are treated
+// as having priority 0. See WithPriorityAging for how starvation is avoided.
+func (l *Limiter) AcquirePriority(ctx context.Context, prio int) error {
+	n := l.costOf(ctx)
+	if n <= 0 {
+		return nil
+	}
+	return l.acquire(ctx, &acquisition{n: n, prio: prio, queued: true})
+}
+
+// A waiter is a caller queued for tokens. ready is closed when the waiter
+// first reaches the front of the queue.
+type waiter struct {
+	ready    chan struct{}
+	released bool // ready has been closed
+	prio     int
+	n        int // tokens wanted
+	arrived  time.Time
+}
+
+// acquireQueued joins the queue and waits for the tokens once a reaches the
+// front.
+func (l *Limiter) acquireQueued(ctx context.Context, a *acquisition) error {
+	a.w = l.enqueue(a.prio, a.n)
+	defer l.dequeue(a.w)
+
+	select {
+	case <-a.w.ready:
+	default:
+		// Everyone ahead has to be served first, so don't join the back of a
+		// queue that won't clear in time.
+		if err := l.giveUp(ctx, a, l.queueWait(a)); err != nil {
+			return err
+		}
+		if err := l.block(a); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-l.done:
+			return ErrClosed
+		case <-a.w.ready:
+		}
+	}
+	return l.wait(ctx, a)
+}
+
+// enqueue adds a new waiter for n tokens to the queue, moving it straight to
+// the front if it outranks the current head.
+func (l *Limiter) enqueue(prio, n int) *waiter {
+	l.lock()
+	defer l.unlock()
+
+	now := l.clock.Now()
+	w := &waiter{ready: make(chan struct{}), prio: prio, n: n, arrived: now}
+	l.waiters = append(l.waiters, w)
+	if l.head == nil || l.effectivePrio(w, now) > l.effectivePrio(l.head, now) {
+		l.promote(w)
+	}
+	return w
+}
+
+// queueWait estimates how long until a's tokens are available, after those
+// of the waiters that will be served before it.
+func (l *Limiter) queueWait(a *acquisition) time.Duration {
+	l.lock()
+	defer l.unlock()
+
+	l.refill()
+	n := a.n - a.debt
+	now := l.clock.Now()
+	for _, w := range l.waiters {
+		if w != a.w && (w == l.head || l.effectivePrio(w, now) >= l.effectivePrio(a.w, now)) {
+			n += w.n
+		}
+	}
+	return l.timeUntil(n)
+}
+
+// dequeue removes w from the queue, whether it was granted tokens or gave up,
+// and picks the next waiter if w was at the front.
+func (l *Limiter) dequeue(w *waiter) {
+	l.lock()
+	defer l.unlock()
+
+	i := slices.Index(l.waiters, w)
+	l.waiters = slices.Delete(l.waiters, i, i+1)
+	if l.head != w {
+		return
+	}
+
+	l.head = nil
+	now := l.clock.Now()
+	for _, c := range l.waiters {
+		// waiters is in arrival order so ties go to whoever came first.
+		if l.head == nil || l.effectivePrio(c, now) > l.effectivePrio(l.head, now) {
+			l.head = c
+		}
+	}
+	if l.head != nil {
+		l.promote(l.head)
+	}
+}
+
+// promote moves w to the front of the queue. A waiter that was already
+// released but has since been overtaken is polling the bucket, so doesn't need
+// to be told. l.mu must be held by the caller.
+func (l *Limiter) promote(w *waiter) {
+	l.head = w
+	if !w.released {
+		w.released = true
+		close(w.ready)
+	}
+}
+
+// effectivePrio returns w's priority including any increase from aging. l.mu
+// must be held by the caller.
+func (l *Limiter) effectivePrio(w *waiter, now time.Time) int {
+	if l.aging <= 0 {
+		return w.prio
+	}
+	return w.prio + int(now.Sub(w.arrived)/l.aging)
+}
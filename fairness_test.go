@@ -0,0 +1,169 @@
+package ratelimiter
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFIFO(t *testing.T) {
+	l := New(1, 20*time.Millisecond, WithFairness(FIFO))
+	if err := l.Acquire(t.Context()); err != nil {
+		t.Fatalf("Unexpected error on Acquire() - %s", err)
+	}
+
+	const nw = 5
+	var (
+		mu    sync.Mutex
+		order []int
+		wg    sync.WaitGroup
+	)
+	for i := range nw {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := l.Acquire(t.Context()); err != nil {
+				t.Errorf("Unexpected error on Acquire() - %s", err)
+			}
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+		}()
+
+		// Wait for the goroutine to join the queue before starting the next
+		// one so that the arrival order is known.
+		for {
+			l.mu.Lock()
+			queued := len(l.waiters)
+			l.mu.Unlock()
+			mu.Lock()
+			done := len(order)
+			mu.Unlock()
+			if queued+done == i+1 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	wg.Wait()
+
+	if want := []int{0, 1, 2, 3, 4}; !slices.Equal(order, want) {
+		t.Errorf("Expected tokens to be granted in order %v, got %v", want, order)
+	}
+}
+
+func TestFIFONoQueueJumping(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	l := New(1, time.Second, WithFairness(FIFO), WithClock(fakeclock))
+
+	// Simulate a caller at the front of the queue waiting for a token
+	w := l.enqueue(0, 1)
+	if l.TryAcquire() {
+		t.Errorf("TryAcquire() should not jump ahead of a queued waiter")
+	}
+	l.dequeue(w)
+
+	if !l.TryAcquire() {
+		t.Errorf("TryAcquire() should succeed once the queue is empty")
+	}
+}
+
+func TestAcquirePriority(t *testing.T) {
+	l := New(1, 20*time.Millisecond, WithPriorityAging(time.Hour))
+	l.Drain()
+
+	prios := []int{0, 5, 1, 5, 3}
+	var (
+		mu    sync.Mutex
+		order []int
+		wg    sync.WaitGroup
+	)
+	for i, prio := range prios {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := l.AcquirePriority(t.Context(), prio); err != nil {
+				t.Errorf("Unexpected error on AcquirePriority() - %s", err)
+			}
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+		}()
+
+		// Wait for the goroutine to join the queue so the arrival order is
+		// known.
+		for {
+			l.mu.Lock()
+			queued := len(l.waiters)
+			l.mu.Unlock()
+			mu.Lock()
+			done := len(order)
+			mu.Unlock()
+			if queued+done == i+1 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	wg.Wait()
+
+	// Highest priority first, arrival order breaks ties
+	if want := []int{1, 3, 4, 2, 0}; !slices.Equal(order, want) {
+		t.Errorf("Expected tokens to be granted in order %v, got %v", want, order)
+	}
+}
+
+func TestPriorityAging(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+	l := New(1, time.Second, WithPriorityAging(time.Second), WithClock(fakeclock))
+
+	head := l.enqueue(10, 1)
+	low := l.enqueue(0, 1)
+
+	// After waiting three seconds the low priority caller outranks a newly
+	// arrived priority 2 caller.
+	fakeclock.Advance(3 * time.Second)
+	high := l.enqueue(2, 1)
+	l.dequeue(head)
+	if l.head != low {
+		t.Errorf("Expected the aged low priority waiter to be next")
+	}
+
+	// But not a priority 5 one
+	l.dequeue(low)
+	l.dequeue(high)
+	low = l.enqueue(0, 1)
+	fakeclock.Advance(3 * time.Second)
+	high = l.enqueue(5, 1)
+	if l.head != high {
+		t.Errorf("Expected the priority 5 waiter to take over the front of the queue")
+	}
+}
+
+func TestAcquireJoinsPriorityQueue(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+	l := New(1, time.Second, WithClock(fakeclock))
+	l.Drain()
+
+	// With a caller queued, a plain Acquire waits in the queue behind it
+	w := l.enqueue(1, 1)
+	errc := make(chan error)
+	go func() {
+		errc <- l.Acquire(t.Context())
+	}()
+	for {
+		l.mu.Lock()
+		queued := len(l.waiters)
+		l.mu.Unlock()
+		if queued == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	l.dequeue(w)
+	if err := <-errc; err != nil {
+		t.Fatalf("Unexpected error on Acquire() - %s", err)
+	}
+}
@@ -1,9 +1,15 @@
 package ratelimiter
 
-import "time"
+import (
+	"sync"
+	"time"
+)
 
 type fakeclock struct {
+	mu                     sync.Mutex // protect access to all fields
 	nowCalled, afterCalled bool
+	afterCount             int
+	sleeps                 []time.Duration
 	fakeNow                time.Time
 }
 
@@ -12,21 +18,70 @@ func newFakeClock(now time.Time) *fakeclock {
 }
 
 func (fc *fakeclock) Now() time.Time {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
 	fc.nowCalled = true
 	return fc.fakeNow
 }
 
 func (fc *fakeclock) After(d time.Duration) <-chan time.Time {
+	// Buffer the channel so that nothing leaks if the caller stops waiting.
+	c := make(chan time.Time, 1)
+	c <- fc.sleep(d)
+	return c
+}
+
+// NewTimer returns a timer that, like After, fires immediately having advanced
+// the clock. Each Reset does the same.
+func (fc *fakeclock) NewTimer(d time.Duration) Timer {
+	ft := &faketimer{fc: fc, c: make(chan time.Time, 1)}
+	ft.Reset(d)
+	return ft
+}
+
+// sleep advances the clock by d on behalf of a caller waiting for that long.
+func (fc *fakeclock) sleep(d time.Duration) time.Time {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
 	fc.afterCalled = true
+	fc.afterCount++
+	fc.sleeps = append(fc.sleeps, d)
 	fc.fakeNow = fc.fakeNow.Add(d)
-	c := make(chan time.Time)
-	go func() {
-		c <- fc.fakeNow
-	}()
-	return c
+	return fc.fakeNow
 }
 
 func (fc *fakeclock) Advance(d time.Duration) time.Time {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
 	fc.fakeNow = fc.fakeNow.Add(d)
 	return fc.fakeNow
 }
+
+type faketimer struct {
+	fc *fakeclock
+	c  chan time.Time
+}
+
+func (ft *faketimer) C() <-chan time.Time {
+	return ft.c
+}
+
+func (ft *faketimer) Reset(d time.Duration) bool {
+	active := ft.Stop()
+	ft.c <- ft.fc.sleep(d)
+	return active
+}
+
+func (ft *faketimer) Stop() bool {
+	// The timer fires straight away, so it is only active if that hasn't been
+	// received yet.
+	select {
+	case <-ft.c:
+		return true
+	default:
+		return false
+	}
+}
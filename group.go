@@ -0,0 +1,111 @@
+package ratelimiter
+
+import (
+	"sync"
+	"time"
+)
+
+// A Group refills many limiters from a single background goroutine. Normally
+// each limiter refills itself lazily as it is used, which means reading the
+// clock on every call. With very large numbers of limiters it can be cheaper to
+// refill them all periodically instead.
+//
+// Limiters in a group only gain tokens when the group ticks, so callers may
+// wait up to one interval longer than they otherwise would.
+type Group struct {
+	mu       sync.Mutex // protect access to limiters and closed
+	limiters []*Limiter
+	closed   bool
+
+	interval time.Duration
+	clock    Clock
+	done     chan struct{}
+	stopped  chan struct{}
+}
+
+// NewGroup creates a Group that refills its limiters every interval, timed by
+// clock. A nil clock uses the system clock, as limiters do by default. Call
+// Close to stop refilling.
+func NewGroup(interval time.Duration, clock Clock) *Group {
+	if clock == nil {
+		clock = &pkgclock{}
+	}
+	g := &Group{
+		interval: interval,
+		clock:    clock,
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go g.run()
+	return g
+}
+
+// Add puts l in the group so that it's refilled by the group's ticker rather
+// than lazily. A limiter can only belong to one group at a time, adding it to a
+// second group has no effect.
+func (g *Group) Add(l *Limiter) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	l.lock()
+	defer l.unlock()
+
+	if g.closed || l.group != nil {
+		return
+	}
+
+	// Bring the bucket up to date before taking over.
+	l.refill()
+	l.group = g
+	g.limiters = append(g.limiters, l)
+}
+
+// Close stops the group's ticker. Limiters in the group go back to refilling
+// themselves lazily.
+func (g *Group) Close() error {
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return nil
+	}
+	g.closed = true
+	close(g.done)
+	g.mu.Unlock()
+
+	<-g.stopped
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, l := range g.limiters {
+		l.lock()
+		l.group = nil
+		l.unlock()
+	}
+	g.limiters = nil
+	return nil
+}
+
+func (g *Group) run() {
+	defer close(g.stopped)
+	for {
+		select {
+		case <-g.done:
+			return
+		case <-g.clock.After(g.interval):
+			g.tick()
+		}
+	}
+}
+
+// tick refills every limiter in the group, reading the clock only once.
+func (g *Group) tick() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.clock.Now()
+	for _, l := range g.limiters {
+		l.lock()
+		l.accrue(now)
+		l.unlock()
+	}
+}
@@ -0,0 +1,74 @@
+package ratelimiter
+
+import (
+	"testing"
+	"time"
+)
+
+// tickClock hands each call to After to the test, which decides when it fires.
+type tickClock struct {
+	*fakeclock
+	waits   chan chan time.Time
+	pending chan time.Time
+}
+
+func newTickClock() *tickClock {
+	return &tickClock{fakeclock: newFakeClock(time.Now()), waits: make(chan chan time.Time)}
+}
+
+func (tc *tickClock) After(d time.Duration) <-chan time.Time {
+	c := make(chan time.Time, 1)
+	tc.waits <- c
+	return c
+}
+
+// tick advances the clock by d and fires the pending wait, returning once the
+// tick has been processed and the next wait has started.
+func (tc *tickClock) tick(d time.Duration) {
+	if tc.pending == nil {
+		tc.pending = <-tc.waits
+	}
+	tc.pending <- tc.Advance(d)
+	tc.pending = <-tc.waits
+}
+
+func TestGroup(t *testing.T) {
+	tc := newTickClock()
+
+	g := NewGroup(100*time.Millisecond, tc)
+	a := New(10, time.Second, WithClock(tc.fakeclock))
+	b := New(20, time.Second, WithClock(tc.fakeclock))
+	g.Add(a)
+	g.Add(b)
+	a.Drain()
+	b.Drain()
+
+	// Without a tick the limiters don't refill themselves
+	tc.Advance(200 * time.Millisecond)
+	if got := a.Tokens(); got != 0 {
+		t.Errorf("Expected a grouped limiter not to refill lazily, has %d tokens", got)
+	}
+
+	// Each tick credits all of the time elapsed since the last
+	tc.tick(100 * time.Millisecond)
+	if got := a.Tokens(); got != 3 {
+		t.Errorf("Expected a to have 3 tokens after a tick, has %d", got)
+	}
+	if got := b.Tokens(); got != 6 {
+		t.Errorf("Expected b to have 6 tokens after a tick, has %d", got)
+	}
+	tc.tick(100 * time.Millisecond)
+	if got := a.Tokens(); got != 4 {
+		t.Errorf("Expected a to have 4 tokens after two ticks, has %d", got)
+	}
+
+	// Once closed the limiters go back to refilling lazily
+	if err := g.Close(); err != nil {
+		t.Fatalf("Unexpected error on Close() - %s", err)
+	}
+	a.Drain()
+	tc.Advance(500 * time.Millisecond)
+	if got := a.Tokens(); got != 5 {
+		t.Errorf("Expected a to refill lazily after Close(), has %d tokens", got)
+	}
+}
@@ -0,0 +1,31 @@
+// Package grpclimiter provides gRPC server interceptors that rate limit calls
+// with a ratelimiter.Limiter. It is kept apart from the core ratelimiter
+// package, which doesn't import gRPC.
+package grpclimiter
+
+import (
+	"context"
+	"errors"
+
+	"github.com/chriskillpack/ratelimiter"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// UnaryServerInterceptor returns an interceptor that waits in l.Acquire before
+// calling the handler. The call's context is used so a client deadline or
+// cancellation stops the wait, in which case the call fails with
+// codes.ResourceExhausted. If the limiter has been closed calls fail with
+// codes.Unavailable.
+func UnaryServerInterceptor(l *ratelimiter.Limiter) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if err := l.Acquire(ctx); err != nil {
+			if errors.Is(err, ratelimiter.ErrClosed) {
+				return nil, status.Error(codes.Unavailable, err.Error())
+			}
+			return nil, status.Errorf(codes.ResourceExhausted, "rate limited: %s", err)
+		}
+		return handler(ctx, req)
+	}
+}
@@ -0,0 +1,65 @@
+package grpclimiter
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/chriskillpack/ratelimiter"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	l := ratelimiter.New(2, time.Hour)
+
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer(grpc.UnaryInterceptor(UnaryServerInterceptor(l)))
+	healthpb.RegisterHealthServer(srv, health.NewServer())
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Unexpected error creating client - %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	client := healthpb.NewHealthClient(conn)
+
+	var ok, exhausted int
+	for range 5 {
+		ctx, cancel := context.WithTimeout(t.Context(), time.Second)
+		_, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+		cancel()
+
+		switch status.Code(err) {
+		case codes.OK:
+			ok++
+		case codes.ResourceExhausted:
+			exhausted++
+		default:
+			t.Errorf("Unexpected error from Check() - %s", err)
+		}
+	}
+	if ok != 2 {
+		t.Errorf("Expected 2 calls to succeed, got %d", ok)
+	}
+	if exhausted != 3 {
+		t.Errorf("Expected 3 calls to be rate limited, got %d", exhausted)
+	}
+
+	l.Close()
+	if _, err := client.Check(t.Context(), &healthpb.HealthCheckRequest{}); status.Code(err) != codes.Unavailable {
+		t.Errorf("Expected Unavailable from a closed limiter, got %s", err)
+	}
+}
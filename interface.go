@@ -0,0 +1,30 @@
+package ratelimiter
+
+import "context"
+
+// Interface is the set of methods used to rate limit work. Code that accepts an
+// Interface rather than a *Limiter can be handed a NopLimiter to disable rate
+// limiting, or a test double.
+type Interface interface {
+	Acquire(ctx context.Context) error
+	TryAcquire() bool
+}
+
+var (
+	_ Interface = (*Limiter)(nil)
+	_ Interface = (*ChainLimiter)(nil)
+	_ Interface = NopLimiter{}
+)
+
+// NopLimiter is an Interface that never limits anything.
+type NopLimiter struct{}
+
+// Acquire always returns nil immediately.
+func (NopLimiter) Acquire(ctx context.Context) error {
+	return nil
+}
+
+// TryAcquire always returns true.
+func (NopLimiter) TryAcquire() bool {
+	return true
+}
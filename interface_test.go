@@ -0,0 +1,45 @@
+package ratelimiter
+
+import (
+	"context"
+	"testing"
+)
+
+func TestNopLimiter(t *testing.T) {
+	var l Interface = NopLimiter{}
+
+	// Even a canceled context doesn't stop it
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	for range 1000 {
+		if err := l.Acquire(ctx); err != nil {
+			t.Fatalf("Unexpected error on Acquire() - %s", err)
+		}
+		if !l.TryAcquire() {
+			t.Fatalf("TryAcquire() returned false")
+		}
+	}
+}
+
+func TestUnlimited(t *testing.T) {
+	var l Interface = Unlimited()
+	for range 10000 {
+		if err := l.Acquire(t.Context()); err != nil {
+			t.Fatalf("Unexpected error on Acquire() - %s", err)
+		}
+		if !l.TryAcquire() {
+			t.Fatalf("TryAcquire() returned false")
+		}
+	}
+
+	u := Unlimited()
+	if err := u.AcquireN(t.Context(), 1_000_000); err != nil {
+		t.Fatalf("Unexpected error on AcquireN() - %s", err)
+	}
+	if got := u.TimeToNext(); got != 0 {
+		t.Errorf("Expected tokens to always be available, next in %s", got)
+	}
+	if blocked := u.Stats().Blocks; blocked != 0 {
+		t.Errorf("Expected no acquires to have blocked, %d did", blocked)
+	}
+}
@@ -0,0 +1,47 @@
+package ratelimiter
+
+import (
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// WithJitter randomizes how long blocked callers sleep by up to ±fraction of
+// the wait, e.g. 0.1 for ±10%, so that callers that blocked together don't
+// all wake together and stampede. A caller that wakes early simply waits
+// again for the shortfall, so jitter never lets work through faster than the
+// rate. fraction is clamped to between 0 and 1. The default is no jitter.
+func WithJitter(fraction float64) Option {
+	return func(l *Limiter) {
+		l.jitter = min(max(fraction, 0), 1)
+	}
+}
+
+// WithRand sets the source of randomness for jitter, so that tests and
+// reproducible deployments can pin it with a seeded r. The limiter serializes
+// its use of r, as do all the limiters the option is applied to, e.g. by
+// NewKeyed, but r shouldn't be used elsewhere at the same time. The default is
+// the math/rand/v2 package's global source.
+func WithRand(r *rand.Rand) Option {
+	var mu sync.Mutex
+	random := func() float64 {
+		mu.Lock()
+		defer mu.Unlock()
+		return r.Float64()
+	}
+	return func(l *Limiter) {
+		l.random = random
+	}
+}
+
+// jittered returns d adjusted by the limiter's jitter.
+func (l *Limiter) jittered(d time.Duration) time.Duration {
+	if l.jitter == 0 {
+		return d
+	}
+	random := l.random
+	if random == nil {
+		random = rand.Float64
+	}
+	return d + time.Duration(l.jitter*(2*random()-1)*float64(d))
+}
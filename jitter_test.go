@@ -0,0 +1,103 @@
+package ratelimiter
+
+import (
+	"math/rand/v2"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sequence returns a source of randomness that cycles through vals.
+func sequence(vals ...float64) func() float64 {
+	var i int
+	return func() float64 {
+		v := vals[i%len(vals)]
+		i++
+		return v
+	}
+}
+
+func TestJitter(t *testing.T) {
+	l := New(10, time.Second, WithJitter(0.2))
+	l.random = sequence(0, 0.25, 0.5, 0.75, 0.999)
+
+	const wait = 100 * time.Millisecond
+	seen := make(map[time.Duration]bool)
+	for range 5 {
+		got := l.jittered(wait)
+		if got < 80*time.Millisecond || got > 120*time.Millisecond {
+			t.Errorf("Expected a jittered wait within ±20%% of %s, got %s", wait, got)
+		}
+		seen[got] = true
+	}
+	if len(seen) != 5 {
+		t.Errorf("Expected the jittered waits to vary, got %d distinct values", len(seen))
+	}
+
+	// Without jitter waits are exact
+	if got := New(10, time.Second).jittered(wait); got != wait {
+		t.Errorf("Expected an unjittered wait of %s, got %s", wait, got)
+	}
+}
+
+func TestJitterNeverWaitsTooLittle(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	l := New(10, time.Second, WithClock(fakeclock), WithJitter(0.5))
+	l.random = sequence(0) // always wake as early as possible
+	l.Drain()
+
+	start := fakeclock.Now()
+	if err := l.Acquire(t.Context()); err != nil {
+		t.Fatalf("Unexpected error on Acquire() - %s", err)
+	}
+	if got := fakeclock.Now().Sub(start); got < 100*time.Millisecond {
+		t.Errorf("Expected Acquire() to wait at least 100ms, waited %s", got)
+	}
+	if fakeclock.afterCount < 2 {
+		t.Errorf("Expected an early wakeup to wait again, slept %d times", fakeclock.afterCount)
+	}
+}
+
+func TestWithRand(t *testing.T) {
+	newLimiter := func() *Limiter {
+		return New(10, time.Second, WithJitter(0.5), WithRand(rand.New(rand.NewPCG(1, 2))))
+	}
+	a, b := newLimiter(), newLimiter()
+
+	const wait = 100 * time.Millisecond
+	seen := make(map[time.Duration]bool)
+	for range 10 {
+		got, want := a.jittered(wait), b.jittered(wait)
+		if got != want {
+			t.Errorf("Expected limiters with the same seed to jitter alike, got %s and %s", got, want)
+		}
+		seen[got] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("Expected the jitter to vary, got %v", seen)
+	}
+}
+
+func TestWithRandShared(t *testing.T) {
+	// Every key's limiter is built from the same option, so they all share r
+	// and must share its lock too. Run with -race.
+	r := rand.New(rand.NewPCG(1, 2))
+	k := NewKeyed(1000, time.Second, time.Hour, WithBurst(1), WithJitter(0.5), WithRand(r))
+
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 20 {
+				if err := k.Acquire(t.Context(), strconv.Itoa(i)); err != nil {
+					t.Errorf("Unexpected error on Acquire() - %s", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,141 @@
+package ratelimiter
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// KeyedLimiter maintains an independent Limiter for each key, e.g. one per API
+// key or client address. Limiters are created on first use and reclaimed once
+// they have been idle for longer than the TTL.
+type KeyedLimiter struct {
+	mu        sync.Mutex // protect access to limiters and lastSweep
+	limiters  map[string]*keyedEntry
+	lastSweep time.Time
+
+	rate   int
+	window time.Duration
+	ttl    time.Duration
+	opts   []Option
+	clock  Clock
+}
+
+type keyedEntry struct {
+	limiter  *Limiter
+	lastUsed time.Time
+}
+
+// NewKeyed creates a KeyedLimiter where each key gets its own limiter, created
+// as if by New(rate, window, opts...). Limiters that haven't been used for ttl
+// are discarded. The ttl should be at least the time it takes for a limiter to
+// refill completely, otherwise dropping a partially drained limiter will hand
+// the key a fresh allowance early.
+func NewKeyed(rate int, window, ttl time.Duration, opts ...Option) *KeyedLimiter {
+	clock := clockFrom(opts)
+	return &KeyedLimiter{
+		limiters:  make(map[string]*keyedEntry),
+		lastSweep: clock.Now(),
+		rate:      rate,
+		window:    window,
+		ttl:       ttl,
+		opts:      opts,
+		clock:     clock,
+	}
+}
+
+// clockFrom returns the clock that opts select, without building a limiter.
+func clockFrom(opts []Option) Clock {
+	var l Limiter
+	for _, opt := range opts {
+		opt(&l)
+	}
+	if l.clock == nil {
+		return &pkgclock{}
+	}
+	return l.clock
+}
+
+// Acquire blocks until work for key can proceed, with the same semantics as
+// Limiter.Acquire. Keys never interfere with each other.
+func (k *KeyedLimiter) Acquire(ctx context.Context, key string) error {
+	return k.limiter(key).Acquire(ctx)
+}
+
+// Penalize takes n tokens from key's limiter, as Limiter.Penalize does, to slow
+// down a key that has misbehaved without affecting any others.
+func (k *KeyedLimiter) Penalize(key string, n int) {
+	k.limiter(key).Penalize(n)
+}
+
+// Len returns the number of keys currently being tracked.
+func (k *KeyedLimiter) Len() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return len(k.limiters)
+}
+
+// SnapshotAll returns the state of every key's limiter, as Limiter.Snapshot
+// does, e.g. for a debug endpoint showing which keys are being throttled. It
+// is safe to call while keys are being acquired from, and doesn't count as
+// using them.
+func (k *KeyedLimiter) SnapshotAll() map[string]State {
+	k.mu.Lock()
+	limiters := make(map[string]*Limiter, len(k.limiters))
+	for key, e := range k.limiters {
+		limiters[key] = e.limiter
+	}
+	k.mu.Unlock()
+
+	// Snapshot outside k.mu so that acquires for other keys aren't held up.
+	states := make(map[string]State, len(limiters))
+	for key, l := range limiters {
+		states[key] = l.Snapshot()
+	}
+	return states
+}
+
+// Evict discards the limiters for keys that have been idle for longer than the
+// TTL and returns how many were removed. Acquire evicts periodically so calling
+// this is only necessary to reclaim memory sooner.
+func (k *KeyedLimiter) Evict() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return k.sweep(k.clock.Now())
+}
+
+// limiter returns the limiter for key, creating it if necessary.
+func (k *KeyedLimiter) limiter(key string) *Limiter {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	// Amortize the cost of eviction by only sweeping once per TTL.
+	now := k.clock.Now()
+	if now.Sub(k.lastSweep) >= k.ttl {
+		k.sweep(now)
+	}
+
+	e, ok := k.limiters[key]
+	if !ok {
+		e = &keyedEntry{limiter: New(k.rate, k.window, k.opts...)}
+		k.limiters[key] = e
+	}
+	e.lastUsed = now
+	return e.limiter
+}
+
+// sweep removes idle limiters. k.mu must be held by the caller.
+func (k *KeyedLimiter) sweep(now time.Time) int {
+	k.lastSweep = now
+
+	var n int
+	for key, e := range k.limiters {
+		if now.Sub(e.lastUsed) > k.ttl {
+			delete(k.limiters, key)
+			n++
+		}
+	}
+	return n
+}
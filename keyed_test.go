@@ -0,0 +1,134 @@
+package ratelimiter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeyedLimiterIndependentKeys(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	k := NewKeyed(2, time.Minute, time.Hour, WithClock(fakeclock))
+	for _, key := range []string{"alice", "alice", "bob", "bob"} {
+		if err := k.Acquire(t.Context(), key); err != nil {
+			t.Fatalf("Unexpected error on Acquire(%q) - %s", key, err)
+		}
+	}
+	if fakeclock.afterCalled {
+		t.Errorf("Keys should have separate buckets but the limiter blocked")
+	}
+
+	// alice is out of tokens but that shouldn't affect a new key
+	if err := k.Acquire(t.Context(), "carol"); err != nil {
+		t.Fatalf("Unexpected error on Acquire() - %s", err)
+	}
+	if fakeclock.afterCalled {
+		t.Errorf("A new key should not have blocked")
+	}
+
+	if err := k.Acquire(t.Context(), "alice"); err != nil {
+		t.Fatalf("Unexpected error on Acquire() - %s", err)
+	}
+	if !fakeclock.afterCalled {
+		t.Errorf("alice is out of tokens and should have blocked")
+	}
+}
+
+func TestKeyedLimiterPenalize(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	k := NewKeyed(2, time.Minute, time.Hour, WithClock(fakeclock))
+	k.Penalize("mallory", 2)
+	if err := k.Acquire(t.Context(), "alice"); err != nil {
+		t.Fatalf("Unexpected error on Acquire() - %s", err)
+	}
+	if fakeclock.afterCalled {
+		t.Errorf("Penalizing one key should not slow down another")
+	}
+
+	if err := k.Acquire(t.Context(), "mallory"); err != nil {
+		t.Fatalf("Unexpected error on Acquire() - %s", err)
+	}
+	if !fakeclock.afterCalled {
+		t.Errorf("A penalized key should have blocked")
+	}
+}
+
+func TestKeyedLimiterSnapshotAll(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	k := NewKeyed(3, time.Minute, time.Hour, WithClock(fakeclock))
+	for key, n := range map[string]int{"alice": 1, "bob": 2, "carol": 3} {
+		for range n {
+			if err := k.Acquire(t.Context(), key); err != nil {
+				t.Fatalf("Unexpected error on Acquire(%q) - %s", key, err)
+			}
+		}
+	}
+
+	states := k.SnapshotAll()
+	want := map[string]int{"alice": 2, "bob": 1, "carol": 0}
+	if len(states) != len(want) {
+		t.Errorf("Expected %d keys in the snapshot, got %v", len(want), states)
+	}
+	for key, tokens := range want {
+		s, ok := states[key]
+		if !ok {
+			t.Errorf("Expected %q in the snapshot", key)
+			continue
+		}
+		if s.Tokens != tokens {
+			t.Errorf("Expected %q to have %d tokens, has %d", key, tokens, s.Tokens)
+		}
+		if !s.LastTime.Equal(fakeclock.Now()) {
+			t.Errorf("Expected %q to have been refilled at %s, got %s", key, fakeclock.Now(), s.LastTime)
+		}
+	}
+}
+
+func TestKeyedLimiterEviction(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	k := NewKeyed(2, time.Minute, 10*time.Minute, WithClock(fakeclock))
+	for _, key := range []string{"alice", "bob"} {
+		if err := k.Acquire(t.Context(), key); err != nil {
+			t.Fatalf("Unexpected error on Acquire(%q) - %s", key, err)
+		}
+	}
+
+	// Keep bob busy while alice goes idle
+	fakeclock.Advance(6 * time.Minute)
+	if err := k.Acquire(t.Context(), "bob"); err != nil {
+		t.Fatalf("Unexpected error on Acquire() - %s", err)
+	}
+	fakeclock.Advance(6 * time.Minute)
+	if got := k.Evict(); got != 1 {
+		t.Errorf("Expected 1 key to be evicted, got %d", got)
+	}
+	if got := k.Len(); got != 1 {
+		t.Errorf("Expected 1 key to remain, got %d", got)
+	}
+
+	// Acquire sweeps idle keys without needing an explicit Evict
+	fakeclock.Advance(time.Hour)
+	if err := k.Acquire(t.Context(), "carol"); err != nil {
+		t.Fatalf("Unexpected error on Acquire() - %s", err)
+	}
+	if got := k.Len(); got != 1 {
+		t.Errorf("Expected only carol to remain, have %d keys", got)
+	}
+}
+
+func TestNewKeyedBuildsNoLimiters(t *testing.T) {
+	// Limiters are only created for keys as they're used, not to work out the
+	// clock the options select
+	fakeclock := newFakeClock(time.Now())
+	before := nextID.Load()
+	k := NewKeyed(2, time.Minute, time.Hour, WithClock(fakeclock))
+	if got := nextID.Load(); got != before {
+		t.Errorf("Expected NewKeyed() not to create a limiter, %d were", got-before)
+	}
+	if k.clock != fakeclock {
+		t.Errorf("Expected NewKeyed() to use the clock from its options")
+	}
+}
@@ -7,93 +7,1586 @@
 // closed.
 //
 // Internally the rate limit uses a simple token bucket approach which is both
-// simple and handles average and bursty loads well.
+// simple and handles average and bursty loads well. Other algorithms can be
+// selected with WithAlgorithm.
 package ratelimiter
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// A simple rate limiter that uses the token bucket algorithm.
+// ErrTooManyTokens is returned by AcquireN when more tokens are requested than
+// the bucket can ever hold.
+var ErrTooManyTokens = errors.New("ratelimiter: requested more tokens than the bucket can hold")
+
+// ErrWouldBlockTooLong is returned by AcquireWait when the tokens won't be
+// available within the maximum wait.
+var ErrWouldBlockTooLong = errors.New("ratelimiter: wait would exceed the maximum")
+
+// ErrTooManyWaiters is returned by Acquire when the limit set by WithMaxWaiters
+// has been reached and the caller would have to block.
+var ErrTooManyWaiters = errors.New("ratelimiter: too many waiters")
+
+// ErrInvalidRate is returned by NewChecked when the rate is not positive.
+var ErrInvalidRate = errors.New("ratelimiter: rate must be positive")
+
+// ErrInvalidWindow is returned by NewChecked when the window is not positive,
+// and by Acquire on a limiter that has somehow been given such a window.
+var ErrInvalidWindow = errors.New("ratelimiter: window must be positive")
+
+// ErrClosed is returned when acquiring from a Limiter that has been closed.
+var ErrClosed = errors.New("ratelimiter: limiter is closed")
+
+// ErrCanceled is returned by AcquireChan when the done channel is closed before
+// a token is available.
+var ErrCanceled = errors.New("ratelimiter: acquire canceled")
+
+// WaitError is returned by Acquire when it gives up waiting for tokens because
+// the context was canceled or its deadline passed. It records how long the
+// caller waited before giving up. errors.Is can be used to check the cause,
+// e.g. errors.Is(err, context.Canceled).
+type WaitError struct {
+	Cause  error         // the context's error
+	Waited time.Duration // how long was spent waiting
+}
+
+// Error returns the error message of the underlying cause.
+func (e *WaitError) Error() string {
+	return e.Cause.Error()
+}
+
+// Unwrap returns the underlying cause.
+func (e *WaitError) Unwrap() error {
+	return e.Cause
+}
+
+// A simple rate limiter that uses the token bucket algorithm by default. See
+// WithAlgorithm for alternatives.
+//
+// A Limiter must be passed by pointer and not copied, a copy would share some
+// of its state and not the rest. go vet reports copies, as it does for any
+// struct holding a sync.Mutex. Clone creates an independent limiter with the
+// same configuration.
 type Limiter struct {
-	mu       sync.Mutex // protect access to lastTime and tokens
-	lastTime time.Time
-	tokens   int
+	mu        sync.Mutex // protect access to the bucket state below
+	lastTime  time.Time
+	tokens    int
+	remainder int64 // fractional token credit, in nanoseconds*rate
+	closed    bool
+	done      chan struct{} // closed by Close to wake blocked callers
+	waiters   []*waiter     // queued callers, in arrival order
+	head      *waiter       // the queued caller next in line for tokens
+	log       *slidingLog   // only used by the SlidingWindow algorithm
+	group     *Group        // refills the bucket, if set
+	pending   []func()      // callbacks to run once l.mu is released
+	reserved  time.Time     // when the latest uncancelable reservation is ready
+	exhausted bool          // whether the bucket was empty, see WithStateChange
+
+	// Reservations made with Reservation that are still to come, and canceled
+	// ones keeping tokens back for them. See Reservation.Cancel.
+	holds []*Reservation
+
+	// Tokens lent to the lock-free fast path, and until when it may use them
+	// as an offset from epoch, when the limiter was created. See lend.
+	fast      atomic.Int64
+	fastUntil atomic.Int64
+	epoch     time.Time
+
+	timers sync.Pool // stopped Timers for blocked callers to reuse
+
+	draining   atomic.Bool    // Shutdown has been called
+	inflight   sync.WaitGroup // blocking acquires admitted before Shutdown
+	numBlocked atomic.Int64   // callers currently blocked in Acquire
+	stats      counters
+	id         uint64 // orders limiters for AcquireAll
+	maxWaiters int
+
+	window     time.Duration
+	rate       int
+	burst      int
+	fixedBurst bool // burst was set explicitly rather than following rate
+	initial    int  // tokens to start with, if initialSet
+	initialSet bool
+	maxBorrow  int           // see WithMaxBorrow
+	timeout    time.Duration // see WithDefaultTimeout
+	minWait    time.Duration // see WithMinWait
+	bestEffort bool          // see WithBestEffort
+	costFunc   func(ctx context.Context) int
+	onExhaust  func(exhausted bool) // see WithStateChange
+	shadow     atomic.Pointer[shadowing]
+	boost      int           // extra burst, see BoostUntil
+	boostUntil time.Time     // when the boost ends
+	warmup     time.Duration // see WithWarmup
+	startRate  int
+	clock      Clock
+	fairness   Fairness
+	aging      time.Duration // see WithPriorityAging
+	agingSet   bool
+	algorithm  Algorithm
+	observer   Observer
+	logger     func(event string, kv ...any)
+	jitter     float64                // see WithJitter
+	regressed  func(by time.Duration) // see WithClockRegression
+	random     func() float64         // source of jitter in [0, 1), if not the default
+}
+
+// An Option configures a Limiter, see New.
+type Option func(*Limiter)
+
+// WithBurst sets the capacity of the bucket, the maximum number of tokens that
+// can be used in a burst. Tokens still accumulate at the rate given to New. By
+// default the burst is the same as the rate.
+func WithBurst(burst int) Option {
+	return func(l *Limiter) {
+		l.burst = burst
+		l.fixedBurst = true
+	}
+}
+
+// WithNoBurst paces work evenly, at most one unit every window/rate, however
+// long the limiter has been idle. It is the same as WithBurst(1): the bucket
+// holds a single token, so idle time can't build up a batch. See also the
+// LeakyBucket algorithm, which also serves blocked callers in order.
+func WithNoBurst() Option {
+	return WithBurst(1)
+}
 
-	window time.Duration
-	rate   int
+// WithInitialTokens sets how many tokens the bucket starts with, so that a
+// newly started service ramps up rather than allowing a full burst straight
+// away. Zero starts the bucket empty. By default the bucket starts full, and n
+// is capped at the burst.
+func WithInitialTokens(n int) Option {
+	return func(l *Limiter) {
+		l.initial = n
+		l.initialSet = true
+	}
+}
+
+// WithMaxBorrow lets AcquireBorrow take the bucket up to n tokens into debt,
+// for work that would rather go over the limit now and be throttled harder
+// afterwards. The debt is repaid as the bucket refills, so until it has been
+// later acquires wait longer than usual. The default, zero, allows no
+// borrowing. It has no effect with the SlidingWindow algorithm.
+func WithMaxBorrow(n int) Option {
+	return func(l *Limiter) {
+		l.maxBorrow = max(n, 0)
+	}
+}
+
+// WithDefaultTimeout makes blocking acquires give up after d, as if the context
+// had a deadline, when the caller's context doesn't have a deadline of its own.
+// A context deadline, however far away, always takes precedence. This saves
+// deriving a context at every call site that shares a limiter. The default,
+// zero, means no timeout.
+func WithDefaultTimeout(d time.Duration) Option {
+	return func(l *Limiter) {
+		l.timeout = d
+	}
+}
+
+// WithMinWait sets the shortest time a blocked caller sleeps before checking
+// the bucket again. At very high rates the time until the next token can be a
+// microsecond or less, and callers repeatedly waking for each one burn CPU.
+// Sleeping for at least d instead lets tokens build up in between, at the cost
+// of some latency. The default is no minimum.
+func WithMinWait(d time.Duration) Option {
+	return func(l *Limiter) {
+		l.minWait = d
+	}
+}
+
+// WithBestEffort makes the blocking acquire methods, such as Acquire, never
+// block. They take the tokens if the bucket holds them and otherwise let the
+// caller through anyway, returning nil and counting the acquire in
+// Stats.OverLimit. This allows the same code to enforce the limit in some
+// environments and merely monitor it in others. Errors such as ErrClosed are
+// still returned.
+func WithBestEffort() Option {
+	return func(l *Limiter) {
+		l.bestEffort = true
+	}
+}
+
+// WithCostFunc sets a function that Acquire calls to find out how many tokens
+// the work costs, e.g. from a request size stored in ctx, rather than taking a
+// single token. This keeps the cost policy in one place instead of at every
+// call site. It has no effect on methods that are given a cost, such as
+// AcquireN.
+func WithCostFunc(fn func(ctx context.Context) int) Option {
+	return func(l *Limiter) {
+		l.costFunc = fn
+	}
+}
+
+// WithStateChange sets a function to be called when the bucket runs out of
+// tokens, with exhausted true, and when it has tokens again, with exhausted
+// false, e.g. to alert when a client keeps hitting its limit. The bucket is
+// checked whenever the limiter is used, so a bucket that refills while nobody
+// is using it is only seen to recover on the next call. fn is called without
+// any of the limiter's locks held.
+func WithStateChange(fn func(exhausted bool)) Option {
+	return func(l *Limiter) {
+		l.onExhaust = fn
+	}
+}
+
+// WithClockRegression sets a function to be called when the limiter's clock
+// goes backwards, with how far it went, to help track down clock problems. The
+// limiter copes by adding no tokens until the clock has caught up. fn is called
+// without any locks held, and may be called for every use of the limiter until
+// then.
+func WithClockRegression(fn func(by time.Duration)) Option {
+	return func(l *Limiter) {
+		l.regressed = fn
+	}
+}
+
+// WithMaxWaiters limits how many callers can be blocked waiting for tokens at
+// once. Once n callers are waiting, acquires that would block fail immediately
+// with ErrTooManyWaiters rather than growing the backlog. Zero, the default,
+// means no limit.
+func WithMaxWaiters(n int) Option {
+	return func(l *Limiter) {
+		l.maxWaiters = n
+	}
+}
+
+// WithClock sets the clock the limiter uses to measure the passage of time.
+// This is primarily useful for driving a limiter deterministically in tests.
+func WithClock(c Clock) Option {
+	return func(l *Limiter) {
+		l.clock = c
+	}
 }
 
 // NewLimiter creates a new rate limiter for the given number of tokens
 // over the provided time window. E.g. NewLimiter(10, time.Minute) will
 // allow 10 units of work to happen over a minute. The limiter is already full
-// so the caller can immediately get all
-func New(rate int, window time.Duration) *Limiter {
-	return &Limiter{
-		window:   window,
-		rate:     rate,
-		lastTime: clock.Now(),
-		tokens:   rate,
+// so the caller can immediately get all. Options are applied in order and can
+// be used to further customize the limiter.
+func New(rate int, window time.Duration, opts ...Option) *Limiter {
+	l := &Limiter{}
+	l.init(rate, window, opts...)
+	return l
+}
+
+// init sets up a zero Limiter as described by New.
+func (l *Limiter) init(rate int, window time.Duration, opts ...Option) {
+	l.id = nextID.Add(1)
+	l.window = window
+	l.rate = rate
+	l.burst = rate
+	l.clock = &pkgclock{}
+	l.done = make(chan struct{})
+	for _, opt := range opts {
+		opt(l)
+	}
+	if !l.agingSet {
+		l.aging = window
+	}
+	switch l.algorithm {
+	case SlidingWindow:
+		l.burst = rate
+		l.log = newSlidingLog(rate, window)
+	case LeakyBucket:
+		// A token bucket that can only hold a single token drips out work at
+		// a constant rate.
+		l.burst = 1
+		l.fairness = FIFO
+	}
+	l.tokens = l.burst
+	l.lastTime = l.clock.Now()
+	l.epoch = l.lastTime
+	if l.initialSet {
+		l.tokens = max(0, min(l.initial, l.burst))
+		if l.log != nil {
+			// Account for the missing tokens as if they were just used.
+			l.log.add(l.lastTime, l.burst-l.tokens)
+		}
 	}
 }
 
+// NewEvery creates a limiter that adds a token every interval, holding at most
+// burst tokens, e.g. NewEvery(2*time.Second, 1) allows half a unit of work per
+// second. This is convenient for rates slower than one per time unit, and is
+// equivalent to New(1, interval, WithBurst(burst)).
+func NewEvery(interval time.Duration, burst int, opts ...Option) *Limiter {
+	return New(1, interval, append([]Option{WithBurst(burst)}, opts...)...)
+}
+
+// NewPerSecond creates a limiter allowing n units of work per second. It is the
+// same as New(n, time.Second, opts...).
+func NewPerSecond(n int, opts ...Option) *Limiter {
+	return New(n, time.Second, opts...)
+}
+
+// NewPerMinute creates a limiter allowing n units of work per minute.
+func NewPerMinute(n int, opts ...Option) *Limiter {
+	return New(n, time.Minute, opts...)
+}
+
+// NewPerHour creates a limiter allowing n units of work per hour.
+func NewPerHour(n int, opts ...Option) *Limiter {
+	return New(n, time.Hour, opts...)
+}
+
+// Unlimited returns a limiter that never runs out of tokens, so Acquire always
+// returns straight away, e.g. for when rate limiting has been turned off by a
+// feature flag. Unlike NopLimiter it is a *Limiter, so it can be used wherever
+// one is expected, and it can be limited later with SetRate.
+func Unlimited() *Limiter {
+	return New(math.MaxInt, time.Second)
+}
+
+// NewChecked is like New but validates its arguments first, returning
+// ErrInvalidRate or ErrInvalidWindow if either is not positive. New does not
+// check and a limiter created with bad arguments misbehaves when used, so
+// prefer NewChecked when the values come from configuration.
+func NewChecked(rate int, window time.Duration, opts ...Option) (*Limiter, error) {
+	if rate <= 0 {
+		return nil, ErrInvalidRate
+	}
+	if window <= 0 {
+		return nil, ErrInvalidWindow
+	}
+	return New(rate, window, opts...), nil
+}
+
 // Acquire returns nil if work can proceed immediately. If the provided context
-// is Done Acquire will return context.Err(). If the bucket is empty, Acquire
-// will block until at least one unit of work can be executed.
+// is Done Acquire will return a *WaitError wrapping context.Err(). If the
+// bucket is empty, Acquire will block until at least one unit of work can be
+// executed. If the context has a deadline that will pass before a token
+// becomes available Acquire returns context.DeadlineExceeded, also wrapped in a
+// *WaitError, straight away rather than waiting. Acquire takes as many tokens
+// as the work costs, as if by AcquireN, where the cost is given by the function
+// set with WithCostFunc if there is one, or else by CostFrom(ctx), ordinarily
+// one.
 func (l *Limiter) Acquire(ctx context.Context) error {
+	return l.AcquireN(ctx, l.costOf(ctx))
+}
+
+// costOf returns how many tokens the work for ctx costs, as described for
+// Acquire. All the methods that are like Acquire charge this.
+func (l *Limiter) costOf(ctx context.Context) int {
+	if l.costFunc != nil {
+		return l.costFunc(ctx)
+	}
+	return CostFrom(ctx)
+}
+
+// acquireCharged is like Acquire but also returns how many tokens it took, for
+// callers such as ChainLimiter that may have to give them back.
+func (l *Limiter) acquireCharged(ctx context.Context) (int, error) {
+	n := l.costOf(ctx)
+	if n <= 0 {
+		return 0, nil
+	}
+	a := &acquisition{n: n}
+	if err := l.acquire(ctx, a); err != nil {
+		return 0, err
+	}
+	if a.unpaid {
+		// Let through by WithBestEffort without taking anything.
+		return 0, nil
+	}
+	return n, nil
+}
+
+type costKey struct{}
+
+// WithCost returns a copy of ctx declaring that the work it is for costs cost
+// tokens, which Acquire then charges. This lets one layer, such as an HTTP
+// middleware that knows the size of a request, decide the cost while another,
+// such as Middleware, does the limiting.
+func WithCost(ctx context.Context, cost int) context.Context {
+	return context.WithValue(ctx, costKey{}, cost)
+}
+
+// CostFrom returns the cost declared in ctx with WithCost, or one if there
+// isn't one.
+func CostFrom(ctx context.Context) int {
+	if cost, ok := ctx.Value(costKey{}).(int); ok {
+		return cost
+	}
+	return 1
+}
+
+// Wait blocks until it can take a token, for programs such as command line
+// tools that have no context to hand. Unlike Acquire it can't be canceled, and
+// it returns straight away without a token if the limiter is closed.
+func (l *Limiter) Wait() {
+	_ = l.Acquire(context.Background())
+}
+
+// AcquireRemaining is like Acquire but also returns the number of tokens left
+// in the bucket once it has taken its tokens, e.g. for clients that pace
+// themselves. This is the same as calling Tokens straight afterwards, without
+// racing other callers for the lock. The count is zero if an error is returned.
+func (l *Limiter) AcquireRemaining(ctx context.Context) (int, error) {
+	n := l.costOf(ctx)
+	if n <= 0 {
+		return 0, nil
+	}
+	a := &acquisition{n: n, counted: true}
+	if err := l.acquire(ctx, a); err != nil {
+		return 0, err
+	}
+	return a.left, nil
+}
+
+// AcquireN is like Acquire but for work that costs n tokens. It blocks until
+// n tokens are available and then consumes all of them at once, never some of
+// them: if ctx is done or the wait fails for any other reason, the bucket is
+// left as it would have been had AcquireN not been called. If n is larger
+// than the capacity (burst) of the bucket AcquireN returns ErrTooManyTokens
+// immediately, since waiting would never succeed. If the burst is lowered by
+// SetRate while AcquireN is waiting it may also return ErrTooManyTokens.
+//
+// AcquireN is intended for work whose cost varies, e.g. middleware that charges
+// requests by size. Work that costs nothing, n <= 0, always proceeds and
+// AcquireN returns nil without touching the bucket.
+func (l *Limiter) AcquireN(ctx context.Context, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	return l.acquire(ctx, &acquisition{n: n})
+}
+
+// AcquireWait is like Acquire but gives up with ErrWouldBlockTooLong if the
+// tokens won't be available within maxWait, without waiting. This avoids having
+// to derive a context with a deadline. Cancellation of ctx is still honored.
+func (l *Limiter) AcquireWait(ctx context.Context, maxWait time.Duration) error {
+	n := l.costOf(ctx)
+	if n <= 0 {
+		return nil
+	}
+	return l.acquire(ctx, &acquisition{n: n, maxWait: maxWait, capped: true})
+}
+
+// AcquireChan is like Acquire for code that signals cancellation by closing a
+// channel rather than with a context. It returns ErrCanceled if done is closed
+// while waiting for a token.
+func (l *Limiter) AcquireChan(done <-chan struct{}) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	err := l.Acquire(ctx)
+	if errors.Is(err, context.Canceled) {
+		return ErrCanceled
+	}
+	return err
+}
+
+// AcquireTimed is like Acquire but also reports how long it waited for the
+// tokens, as measured by the limiter's clock.
+func (l *Limiter) AcquireTimed(ctx context.Context) (time.Duration, error) {
+	n := l.costOf(ctx)
+	if n <= 0 {
+		return 0, nil
+	}
+	a := &acquisition{n: n}
+	err := l.acquire(ctx, a)
+	return a.waited, err
+}
+
+// AcquireBlocked is like Acquire but also reports whether it had to wait for
+// the bucket to refill, which is handy for counting throttled calls.
+func (l *Limiter) AcquireBlocked(ctx context.Context) (blocked bool, err error) {
+	n := l.costOf(ctx)
+	if n <= 0 {
+		return false, nil
+	}
+	a := &acquisition{n: n}
+	err = l.acquire(ctx, a)
+	return a.blocked, err
+}
+
+// AcquireBorrow is like AcquireN but, if the bucket is short, borrows against
+// future tokens rather than waiting, taking the bucket as far into debt as
+// WithMaxBorrow allows. It only blocks if that would take on too much debt, in
+// which case it waits until enough has been repaid. Without WithMaxBorrow it is
+// the same as AcquireN.
+func (l *Limiter) AcquireBorrow(ctx context.Context, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	return l.acquire(ctx, &acquisition{n: n, debt: l.maxBorrow})
+}
+
+// RunLimited acquires a token, blocking as Acquire does, and then runs fn. It
+// returns the error from Acquire, in which case fn is not run, or else the
+// error returned by fn.
+func (l *Limiter) RunLimited(ctx context.Context, fn func() error) error {
+	if err := l.Acquire(ctx); err != nil {
+		return err
+	}
+	return fn()
+}
+
+// A Goer runs functions concurrently, such as an errgroup.Group from
+// golang.org/x/sync/errgroup. It lets Go work with errgroup without this
+// package depending on it.
+type Goer interface {
+	Go(fn func() error)
+}
+
+// Go acquires a token, blocking as Acquire does, and then starts fn on g, e.g.
+// to pace the start of tasks fanned out with errgroup. If Acquire fails fn is
+// not run and instead the error is reported to g, as if fn had returned it.
+// Because Go blocks until the token has been granted, a loop calling it starts
+// no more tasks than the rate allows.
+func (l *Limiter) Go(ctx context.Context, g Goer, fn func() error) {
+	if err := l.Acquire(ctx); err != nil {
+		g.Go(func() error { return err })
+		return
+	}
+	g.Go(fn)
+}
+
+// AcquireFloat is like AcquireN but for work that costs a fractional number of
+// tokens, e.g. 0.25 for something a quarter as expensive as the usual unit of
+// work. The bucket keeps the credit it has accrued towards its next token, so
+// four acquires costing 0.25 take just as long as one costing 1. With the
+// SlidingWindow algorithm, which can only record whole units of work, the cost
+// is rounded up. Work that costs nothing always proceeds.
+func (l *Limiter) AcquireFloat(ctx context.Context, cost float64) error {
+	if !(cost > 0) {
+		return nil
+	}
+	if cost >= math.MaxInt {
+		return ErrTooManyTokens
+	}
+	n, frac := math.Modf(cost)
+	return l.acquire(ctx, &acquisition{n: int(n), frac: frac})
+}
+
+// AcquireWithBackoff is like Acquire but while the bucket is empty it polls
+// with exponential backoff, sleeping for base at first and doubling each time
+// up to max, rather than until the next token is due. This means fewer wakeups
+// when the bucket stays empty for a long time, at the cost of sometimes
+// sleeping after a token has arrived. It still returns as soon as ctx is done.
+// If base or max isn't positive it waits as Acquire does.
+func (l *Limiter) AcquireWithBackoff(ctx context.Context, base, max time.Duration) error {
+	if max < base {
+		base = max
+	}
+	n := l.costOf(ctx)
+	if n <= 0 {
+		return nil
+	}
+	return l.acquire(ctx, &acquisition{n: n, backoff: base, maxBackoff: max})
+}
+
+// An acquisition tracks the progress of a single blocking acquire.
+type acquisition struct {
+	n          int           // tokens wanted
+	maxWait    time.Duration // longest the caller is prepared to wait, if capped
+	capped     bool
+	prio       int           // priority in the queue
+	queued     bool          // always wait in the queue
+	debt       int           // how far into debt the bucket may go to satisfy this
+	counted    bool          // report the tokens left, which the fast path can't
+	frac       float64       // a fraction of a token wanted on top of n
+	backoff    time.Duration // next sleep, growing up to maxBackoff, if set
+	maxBackoff time.Duration
+
+	w        *waiter       // place in the FIFO queue, if any
+	start    time.Time     // when the acquire began
+	deadline time.Time     // when to give up, by the limiter's clock, if set
+	blocked  bool          // whether it has had to wait
+	waited   time.Duration // total time spent waiting, set once finished
+	left     int           // tokens left in the bucket once granted
+	unpaid   bool          // granted without tokens, see WithBestEffort
+}
+
+// acquire is the common implementation of the blocking acquire methods.
+func (l *Limiter) acquire(ctx context.Context, a *acquisition) error {
+	// Most of the time the tokens are plainly available.
+	if !a.queued && !a.counted && a.frac == 0 && l.takeFast(a.n) {
+		l.stats.acquires.Add(1)
+		if l.observer != nil {
+			l.observer.OnAcquire(0)
+		}
+		l.emit("granted", "tokens", a.n, "waited", time.Duration(0))
+		l.mirror(a.n, true)
+		return nil
+	}
+
+	if l.bestEffort {
+		return l.acquireBestEffort(a)
+	}
+
+	l.lock()
+	burst := l.burst
+	if l.draining.Load() {
+		l.unlock()
+		return ErrClosed
+	}
+	l.inflight.Add(1)
+	l.unlock()
+	defer l.inflight.Done()
+	if a.n > burst+a.debt || a.n == burst+a.debt && a.frac > 0 {
+		return ErrTooManyTokens
+	}
+
+	a.start = l.clock.Now()
+	if _, ok := ctx.Deadline(); !ok && l.timeout > 0 {
+		a.deadline = a.start.Add(l.timeout)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.timeout)
+		defer cancel()
+	}
+
+	var err error
+	if a.queued || l.fairness == FIFO {
+		err = l.acquireQueued(ctx, a)
+	} else if err = l.wait(ctx, a); err == errQueued {
+		// Others are queued ahead, e.g. in AcquirePriority, so join them.
+		err = l.acquireQueued(ctx, a)
+	}
+
+	if a.blocked {
+		l.numBlocked.Add(-1)
+	}
+	a.waited = l.clock.Now().Sub(a.start)
+	cancelled := errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+	if cancelled {
+		err = &WaitError{Cause: err, Waited: a.waited}
+	}
+
+	l.stats.waitTime.Add(int64(a.waited))
+	switch {
+	case err == nil:
+		l.stats.acquires.Add(1)
+	case cancelled:
+		l.stats.cancellations.Add(1)
+	}
+
+	if l.observer != nil {
+		switch {
+		case err == nil:
+			l.observer.OnAcquire(a.waited)
+		case cancelled:
+			l.observer.OnCancelled()
+		}
+	}
+	switch {
+	case err == nil:
+		l.emit("granted", "tokens", a.n, "waited", a.waited)
+	case cancelled:
+		l.emit("cancelled", "tokens", a.n, "waited", a.waited)
+	}
+	l.mirror(a.n, err == nil && !a.blocked)
+	return err
+}
+
+// acquireBestEffort takes the tokens for a if they are available, and otherwise
+// lets the caller through as over the limit.
+func (l *Limiter) acquireBestEffort(a *acquisition) error {
+	if l.draining.Load() {
+		return ErrClosed
+	}
+	_, left, err := l.takeDebt(a.n, a.frac, a.debt, nil)
+	switch err {
+	case nil:
+		a.left = left
+	case errNotReady, errQueued, ErrTooManyTokens:
+		a.unpaid = true
+		l.stats.overLimit.Add(1)
+		l.emit("over-limit", "tokens", a.n)
+	default:
+		return err
+	}
+	l.mirror(a.n, err == nil)
+
+	l.stats.acquires.Add(1)
+	if l.observer != nil {
+		l.observer.OnAcquire(0)
+	}
+	l.emit("granted", "tokens", a.n, "waited", time.Duration(0))
+	return nil
+}
+
+// block records that a has had to wait for tokens. It returns
+// ErrTooManyWaiters if there is no room for another blocked caller.
+func (l *Limiter) block(a *acquisition) error {
+	if a.blocked {
+		return nil
+	}
+	if n := l.numBlocked.Add(1); l.maxWaiters > 0 && n > int64(l.maxWaiters) {
+		l.numBlocked.Add(-1)
+		return ErrTooManyWaiters
+	}
+	a.blocked = true
+	l.stats.blocks.Add(1)
+	if l.observer != nil {
+		l.observer.OnBlocked()
+	}
+	l.emit("blocked", "tokens", a.n)
+	return nil
+}
+
+// wait blocks until the tokens for a have been taken from the bucket.
+func (l *Limiter) wait(ctx context.Context, a *acquisition) error {
+	var timer Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+			l.timers.Put(timer)
+		}
+	}()
+
+	for {
+		wait, left, err := l.takeDebt(a.n, a.frac, a.debt, a.w)
+		a.left = left
+		if err == errQueued && a.w == nil {
+			return err
+		}
+		if err != errNotReady && err != errQueued {
+			return err
+		}
+
+		if err := l.giveUp(ctx, a, wait); err != nil {
+			return err
+		}
+		if err := l.block(a); err != nil {
+			return err
+		}
+		// The wait is always at least a nanosecond, even for rates of more
+		// than a token per nanosecond, but jitter could take it to zero.
+		// Sleeping for nothing would spin without time passing.
+		sleep := max(l.jittered(wait), l.minWait, time.Nanosecond)
+		if a.backoff > 0 {
+			sleep = a.backoff
+			a.backoff = min(2*a.backoff, a.maxBackoff)
+		}
+		if timer == nil {
+			timer = l.newTimer(sleep)
+		} else {
+			timer.Reset(sleep)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-l.done:
+			return ErrClosed
+		case <-timer.C():
+			// Sleep until the bucket should have enough tokens, then try
+			// again. Another caller may have got there first in which case
+			// the next wait is recalculated.
+		}
+	}
+}
+
+// giveUp returns an error if a shouldn't bother waiting for tokens that are
+// wait away, because the context will expire, or the caller will have given up,
+// before they arrive.
+func (l *Limiter) giveUp(ctx context.Context, a *acquisition, wait time.Duration) error {
+	now := l.clock.Now()
+	deadline, ok := ctx.Deadline()
+	if !a.deadline.IsZero() {
+		// The default timeout, by the limiter's clock.
+		deadline, ok = a.deadline, true
+	}
+	if ok && deadline.Sub(now) < wait {
+		return context.DeadlineExceeded
+	}
+	if a.capped && now.Add(wait).Sub(a.start) > a.maxWait {
+		return ErrWouldBlockTooLong
+	}
+	return nil
+}
+
+// Close shuts down the limiter. Any callers blocked in Acquire are woken and
+// they, along with all future calls to Acquire, return ErrClosed. TryAcquire
+// and Allow always report false once the limiter is closed. Closing a limiter
+// more than once has no effect.
+func (l *Limiter) Close() error {
+	l.lock()
+	defer l.unlock()
+
+	if !l.closed {
+		l.closed = true
+		close(l.done)
+	}
+	return nil
+}
+
+// Shutdown closes the limiter gracefully. New calls to acquire tokens fail
+// straight away, as they do once the limiter is closed, but callers that were
+// already blocked in Acquire carry on waiting for their tokens. Shutdown waits
+// for them to finish and then closes the limiter. If ctx is done first the
+// limiter is closed anyway, so that the remaining callers are woken with
+// ErrClosed, and Shutdown returns ctx.Err().
+func (l *Limiter) Shutdown(ctx context.Context) error {
+	l.lock()
+	l.draining.Store(true)
+	l.unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		l.inflight.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return l.Close()
+	case <-ctx.Done():
+		l.Close()
+		return ctx.Err()
+	}
+}
+
+// TryAcquire attempts to take a single token from the bucket without blocking.
+// It returns true if a token was consumed and work can proceed, or false if the
+// bucket is empty. Tokens are replenished based on the time elapsed since the
+// last call so repeated polling will eventually succeed.
+func (l *Limiter) TryAcquire() bool {
+	return l.TryAcquireN(1)
+}
+
+// Allow reports whether a unit of work may happen now, consuming a token if so.
+// It never blocks, making it a good fit for shedding load, e.g. responding with
+// 429 Too Many Requests in an HTTP handler. It is equivalent to TryAcquire.
+func (l *Limiter) Allow() bool {
+	return l.TryAcquireN(1)
+}
+
+// AllowAt is like Allow but as of time t rather than the limiter's clock, for
+// tests that step through time without setting up a Clock. Tokens accrue up to
+// t, and the limiter carries on from t, just as if its clock had returned t.
+// Time doesn't go backwards for the limiter, so a t earlier than a previous
+// call adds no tokens.
+func (l *Limiter) AllowAt(t time.Time) bool {
+	l.lock()
+	defer l.unlock()
+
+	if l.closed || l.draining.Load() || l.head != nil {
+		return false
+	}
+	if l.group == nil {
+		l.accrue(t)
+	}
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	if l.log != nil {
+		l.log.add(l.lastTime, 1)
+	}
+	return true
+}
+
+// WouldBlock reports whether Acquire would have to wait if it were called now,
+// because the bucket is empty or other callers are already queued. Unlike
+// TryAcquire it doesn't consume or reserve anything, e.g. to route work
+// elsewhere rather than wait. Acquire on a closed limiter fails straight away
+// so doesn't block.
+func (l *Limiter) WouldBlock() bool {
+	l.lock()
+	defer l.unlock()
+
+	if l.closed || l.draining.Load() {
+		return false
+	}
+	l.refill()
+	return l.head != nil || l.tokens < 1
+}
+
+// TryAcquireN is like TryAcquire but for work that costs n tokens. It takes all
+// n tokens if the bucket holds them, and otherwise takes none and returns
+// false, e.g. to send a whole batch now or defer it entirely. It always returns
+// false if n is larger than the burst.
+func (l *Limiter) TryAcquireN(n int) bool {
+	if n <= 0 {
+		return true
+	}
+	ok := l.takeFast(n)
+	if !ok {
+		_, err := l.take(n, nil)
+		ok = err == nil
+	}
+	l.mirror(n, ok)
+	return ok
+}
+
+// AcquireUpTo takes however many tokens are available right now, up to n,
+// without blocking and returns how many it took, possibly zero. This is useful
+// for sizing a batch of work to the current allowance.
+func (l *Limiter) AcquireUpTo(n int) int {
+	l.lock()
+	defer l.unlock()
+
+	// Respect callers queued in FIFO mode.
+	if l.closed || l.draining.Load() || len(l.waiters) > 0 {
+		return 0
+	}
+
+	l.refill()
+	got := max(0, min(n, l.tokens))
+	l.tokens -= got
+	if l.log != nil {
+		l.log.add(l.lastTime, got)
+	}
+	return got
+}
+
+// Reserve takes a token from the bucket without blocking and returns how long
+// the caller must wait before using it. If a token is available now the wait is
+// zero. Otherwise the token is borrowed from the future and the wait is the
+// time until the bucket will have refilled it, so later reservations wait
+// behind earlier ones. The bucket can go no further into debt than its burst,
+// see Tokens. Reserve returns false, and reserves nothing, if reserving would
+// exceed that, the bucket can never hold a token, the limiter has been closed
+// or it uses the SlidingWindow algorithm.
+func (l *Limiter) Reserve() (time.Duration, bool) {
+	l.lock()
+	defer l.unlock()
+
+	wait, ok := l.reserve(1)
+	if ready := l.lastTime.Add(wait); ok && ready.After(l.reserved) {
+		l.reserved = ready
+	}
+	return wait, ok
+}
+
+// ReserveN is like Reserve but for n tokens, and returns the time at which they
+// will be available rather than the wait, e.g. to schedule a timer. It returns
+// false if n is larger than the burst, as well as in the same cases as
+// Reserve.
+func (l *Limiter) ReserveN(n int) (ready time.Time, ok bool) {
+	l.lock()
+	defer l.unlock()
+
+	if n <= 0 {
+		return l.clock.Now(), true
+	}
+	wait, ok := l.reserve(n)
+	if !ok {
+		return time.Time{}, false
+	}
+	ready = l.lastTime.Add(wait)
+	if ready.After(l.reserved) {
+		l.reserved = ready
+	}
+	return ready, true
+}
+
+// reserve takes n tokens, borrowing them from the future if the bucket is
+// short, and returns how long until the bucket will have refilled them. l.mu
+// must be held by the caller.
+func (l *Limiter) reserve(n int) (time.Duration, bool) {
+	if l.closed || l.draining.Load() || n > l.burst || l.algorithm == SlidingWindow {
+		return 0, false
+	}
+
+	l.refill()
+	if l.tokens-n < l.floor() {
+		return 0, false
+	}
+	wait := l.timeUntil(n)
+	l.tokens -= n
+	return wait, true
+}
+
+// Ready returns a channel that is closed once the bucket holds a token, which
+// may be straight away, so that event driven code can select on it alongside
+// other channels rather than blocking in Acquire. Receiving from the channel
+// doesn't take the token, the caller still has to, e.g. with TryAcquire, and
+// another caller may get there first. Call Ready again for the next token. If
+// the limiter is closed the channel is never closed.
+func (l *Limiter) Ready() <-chan struct{} {
+	ready := make(chan struct{})
+	wait := l.waitFor(1)
+	if wait == 0 {
+		close(ready)
+		return ready
+	}
+
+	go func() {
+		for wait > 0 {
+			select {
+			case <-l.clock.After(wait):
+			case <-l.done:
+				return
+			}
+			wait = l.waitFor(1)
+		}
+		close(ready)
+	}()
+	return ready
+}
+
+// WaitFull blocks until the bucket is full, e.g. to let a limiter cool down
+// before starting a large batch. It doesn't take any tokens. It returns
+// ctx.Err() if ctx is done first, or ErrClosed if the limiter is closed.
+func (l *Limiter) WaitFull(ctx context.Context) error {
 	for {
-		if ok := l.tryAcquire(); ok {
+		l.lock()
+		l.refill()
+		wait := l.timeUntil(l.burst)
+		l.unlock()
+		if wait == 0 {
 			return nil
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		case <-clock.After(l.window / time.Duration(l.rate)):
-			// If tryAcquire() returned false the token bucket is empty.
-			// Assuming an even distribution of tokens across the window, wait
-			// 1/Nth of the window duration to allow at least one token to
-			// accumulate. And then try again.
+		case <-l.done:
+			return ErrClosed
+		case <-l.clock.After(wait):
+			// Others may have taken tokens meanwhile, so check again.
+		}
+	}
+}
+
+// TimeToNext returns how long until a token will be available, zero if one is
+// available now. It doesn't consume or reserve anything, so another caller may
+// take the token first. A typical use is to fill in a Retry-After header.
+func (l *Limiter) TimeToNext() time.Duration {
+	return l.waitFor(1)
+}
+
+// Tokens returns the number of tokens currently in the bucket, after
+// accounting for any that have accumulated since the bucket was last used. The
+// fraction of a token accrued towards the next one is carried over precisely
+// but not counted. It does not consume any tokens. The count is negative while
+// there are outstanding reservations, or borrowed tokens, that the bucket has
+// not yet refilled. It never goes below -burst, or -n with WithMaxBorrow(n) if
+// that is lower, so the time for a limiter to recover is bounded.
+func (l *Limiter) Tokens() int {
+	l.lock()
+	defer l.unlock()
+
+	l.refill()
+	return l.tokens
+}
+
+// LastRefill returns when the bucket was last refilled, by the limiter's clock,
+// for diagnosing a limiter that seems stuck. Most methods refill the bucket but
+// LastRefill doesn't. Nor do acquires that the bucket can plainly satisfy,
+// which take tokens set aside earlier without refilling, so LastRefill can lag
+// behind the clock for a limiter that is in steady use.
+func (l *Limiter) LastRefill() time.Time {
+	l.lock()
+	defer l.unlock()
+
+	return l.lastTime
+}
+
+// SetRate changes the limit to rate tokens per window. Tokens accumulated so
+// far are credited at the old rate first. If the burst wasn't set with
+// WithBurst it follows the new rate, and the bucket is clamped to the new
+// capacity. Callers blocked in Acquire pick up the new rate the next time they
+// check the bucket. SetRate does not validate its arguments, see NewChecked.
+func (l *Limiter) SetRate(rate int, window time.Duration) {
+	l.lock()
+	defer l.unlock()
+
+	l.refill()
+	l.rate = rate
+	l.window = window
+	// The fractional credit is measured in units of the old rate and window.
+	// Rather than rescale it just drop it, losing less than one token.
+	l.remainder = 0
+
+	switch {
+	case l.algorithm == SlidingWindow:
+		l.burst = rate
+		l.log.resize(rate, window)
+	case l.algorithm == LeakyBucket, l.fixedBurst:
+	default:
+		l.burst = rate + l.boost
+	}
+	l.tokens = max(min(l.tokens, l.burst), l.floor())
+	l.refill()
+}
+
+// SetBurst changes the capacity of the bucket, as WithBurst does, so later
+// calls to SetRate leave it alone. Tokens accumulated so far are credited
+// first, and if the bucket holds more than the new burst the excess is
+// discarded. Raising the burst makes room for more tokens to accumulate rather
+// than adding them straight away. SetBurst has no effect with the
+// SlidingWindow and LeakyBucket algorithms.
+func (l *Limiter) SetBurst(burst int) {
+	l.lock()
+	defer l.unlock()
+
+	if l.algorithm == SlidingWindow || l.algorithm == LeakyBucket {
+		return
+	}
+	l.refill()
+	l.burst = burst + l.boost
+	l.fixedBurst = true
+	l.tokens = max(min(l.tokens, l.burst), l.floor())
+}
+
+// BoostUntil raises the capacity of the bucket by extra until the limiter's
+// clock reaches until, e.g. for a planned spike in traffic, without loosening
+// the limit for good. As with SetBurst the extra room fills up at the usual
+// rate rather than straight away. Once the boost is over the capacity reverts,
+// discarding any excess tokens the next time the bucket is refilled. A later
+// call replaces the boost, and SetRate and SetBurst keep it. BoostUntil has no
+// effect with the SlidingWindow and LeakyBucket algorithms.
+func (l *Limiter) BoostUntil(extra int, until time.Time) {
+	l.lock()
+	defer l.unlock()
+
+	if l.algorithm == SlidingWindow || l.algorithm == LeakyBucket {
+		return
+	}
+	l.refill()
+	extra = max(extra, 0)
+	l.burst += extra - l.boost
+	l.boost = extra
+	l.boostUntil = until
+	l.tokens = max(min(l.tokens, l.burst), l.floor())
+}
+
+// unboost ends the boost if now is past the end of it. l.mu must be held by the
+// caller.
+func (l *Limiter) unboost(now time.Time) {
+	if l.boost == 0 || now.Before(l.boostUntil) {
+		return
+	}
+	l.burst -= l.boost
+	l.boost = 0
+	l.tokens = min(l.tokens, l.burst)
+}
+
+// Reset refills the bucket to capacity as if the limiter had just been created.
+func (l *Limiter) Reset() {
+	l.lock()
+	defer l.unlock()
+
+	l.lastTime = l.clock.Now()
+	l.remainder = 0
+	l.tokens = l.burst
+	if l.log != nil {
+		l.log.count = 0
+	}
+}
+
+// Drain empties the bucket so that callers must wait for it to refill.
+func (l *Limiter) Drain() {
+	l.lock()
+	defer l.unlock()
+
+	l.lastTime = l.clock.Now()
+	l.remainder = 0
+	l.tokens = 0
+	if l.log != nil {
+		l.log.count = 0
+		l.log.add(l.lastTime, l.rate)
+	}
+}
+
+// Penalize takes n tokens from the bucket as a penalty, e.g. after a caller has
+// been caught misbehaving, so that callers have to wait longer for the bucket
+// to recover. Unlike a normal take it can leave the bucket in debt, down to the
+// same floor as Reserve, see Tokens. With the SlidingWindow algorithm the
+// bucket can only be emptied, as if by Drain.
+func (l *Limiter) Penalize(n int) {
+	if n <= 0 {
+		return
+	}
+
+	l.lock()
+	defer l.unlock()
+
+	l.refill()
+	if l.log != nil {
+		l.log.add(l.lastTime, min(n, len(l.log.times)-l.log.count))
+		l.tokens = l.rate - l.log.count
+		return
+	}
+	l.tokens = max(l.tokens-n, l.floor())
+}
+
+// Rate returns the number of tokens added to the bucket each window.
+func (l *Limiter) Rate() int {
+	l.lock()
+	defer l.unlock()
+
+	return l.rate
+}
+
+// Window returns the period of time over which Rate tokens are added.
+func (l *Limiter) Window() time.Duration {
+	l.lock()
+	defer l.unlock()
+
+	return l.window
+}
+
+// PerSecond returns the limiter's rate normalized to tokens per second, e.g.
+// 0.5 for New(30, time.Minute). This makes limiters with different windows easy
+// to compare.
+func (l *Limiter) PerSecond() float64 {
+	l.lock()
+	defer l.unlock()
+
+	return float64(l.rate) / l.window.Seconds()
+}
+
+// Clone returns a new limiter with the same configuration as l, including any
+// changes made since it was created such as by SetRate, but with its own full
+// bucket. Nothing is shared between the two except the clock, observer and
+// logger, and the clone doesn't join l's Group if it has one.
+func (l *Limiter) Clone() *Limiter {
+	l.lock()
+	defer l.unlock()
+
+	c := &Limiter{}
+	c.init(l.rate, l.window, func(c *Limiter) {
+		c.maxWaiters = l.maxWaiters
+		c.burst = l.burst
+		c.fixedBurst = l.fixedBurst
+		c.maxBorrow = l.maxBorrow
+		c.timeout = l.timeout
+		c.minWait = l.minWait
+		c.bestEffort = l.bestEffort
+		c.costFunc = l.costFunc
+		c.onExhaust = l.onExhaust
+		c.warmup = l.warmup
+		c.startRate = l.startRate
+		c.boost = l.boost
+		c.boostUntil = l.boostUntil
+		c.clock = l.clock
+		c.fairness = l.fairness
+		c.aging = l.aging
+		c.agingSet = l.agingSet
+		c.algorithm = l.algorithm
+		c.observer = l.observer
+		c.logger = l.logger
+		c.jitter = l.jitter
+		c.random = l.random
+		c.regressed = l.regressed
+	})
+	return c
+}
+
+// String describes the limiter's configuration and current state, e.g.
+// "Limiter(rate=10/1m0s, tokens=7)".
+func (l *Limiter) String() string {
+	l.lock()
+	defer l.unlock()
+
+	l.refill()
+	return fmt.Sprintf("Limiter(rate=%d/%s, tokens=%d)", l.rate, l.window, l.tokens)
+}
+
+// floor returns the lowest the token count can go, putting a bound on how long
+// a limiter in debt takes to recover. l.mu must be held by the caller.
+func (l *Limiter) floor() int {
+	return -max(l.burst, l.maxBorrow)
+}
+
+// errNotReady is returned by take when the tokens aren't available yet.
+var errNotReady = errors.New("ratelimiter: tokens not available")
+
+// errQueued is returned by take when other callers are queued ahead.
+var errQueued = errors.New("ratelimiter: callers queued ahead")
+
+// take consumes n tokens on behalf of w if they are available. If not it
+// leaves the bucket untouched and returns errNotReady, or errQueued if other
+// callers are ahead in the queue, along with how long until they will be. w is
+// the caller's place in the queue, or nil if it doesn't have one.
+func (l *Limiter) take(n int, w *waiter) (time.Duration, error) {
+	if l.draining.Load() {
+		return 0, ErrClosed
+	}
+	wait, _, err := l.takeDebt(n, 0, 0, w)
+	return wait, err
+}
+
+// takeDebt is like take but will leave the bucket up to debt tokens short, and
+// takes frac of a token on top of n. On success it also returns the number of
+// tokens left in the bucket.
+func (l *Limiter) takeDebt(n int, frac float64, debt int, w *waiter) (wait time.Duration, left int, err error) {
+	l.lock()
+	defer l.unlock()
+
+	if l.closed {
+		return 0, 0, ErrClosed
+	}
+	if l.window <= 0 {
+		// There's no sensible rate to refill at, fail rather than divide by
+		// zero.
+		return 0, 0, ErrInvalidWindow
+	}
+	if l.log != nil {
+		// The log can't record work that hasn't happened yet.
+		debt = 0
+	}
+
+	// The fraction of a token is taken from the credit towards the next one,
+	// in the same units as remainder. The log can only record whole tokens.
+	part := int64(math.Ceil(frac * float64(l.window)))
+	if part > 0 && (l.log != nil || part >= int64(l.window)) {
+		n++
+		part = 0
+	}
+	// A full bucket holds no partial credit so even a fraction over the burst
+	// is too many.
+	if n > l.burst+debt || n == l.burst+debt && part > 0 {
+		return 0, 0, ErrTooManyTokens
+	}
+
+	l.refill()
+
+	// Callers that aren't at the front of the queue have to wait their turn.
+	if l.head != nil && l.head != w {
+		return l.timeUntilFrac(n-debt, part), 0, errQueued
+	}
+
+	// If the bucket doesn't hold enough tokens then the caller cannot proceed
+	// immediately.
+	if l.tokens-n < -debt || l.tokens-n == -debt && l.remainder < part {
+		return l.timeUntilFrac(n-debt, part), 0, errNotReady
+	}
+
+	// Success, remove the tokens.
+	l.tokens -= n
+	if part > l.remainder {
+		// Break into a whole token for the fraction.
+		l.tokens--
+		l.remainder += int64(l.window)
+	}
+	l.remainder -= part
+	if l.log != nil {
+		l.log.add(l.lastTime, n)
+	}
+	left = l.tokens
+	l.lend()
+	return 0, left, nil
+}
+
+// takeFast takes n tokens lent to the fast path without acquiring l.mu. It
+// reports false if there aren't enough, in which case the caller falls back to
+// take.
+func (l *Limiter) takeFast(n int) bool {
+	for {
+		have := l.fast.Load()
+		if have < int64(n) || int64(l.clock.Now().Sub(l.epoch)) >= l.fastUntil.Load() {
+			return false
+		}
+		if l.fast.CompareAndSwap(have, have-int64(n)) {
+			if have == int64(n) && l.onExhaust != nil {
+				// That may have emptied the bucket, and unlock checks.
+				l.lock()
+				l.unlock()
+			}
+			return true
 		}
 	}
 }
 
-func (l *Limiter) tryAcquire() bool {
+// lend moves the tokens in the bucket to the fast path so callers can take
+// them without the lock. They are only lent until the bucket would otherwise
+// have filled up, since refilling has to clamp to the burst from that point
+// on, and never while something needs to see each acquisition, such as queued
+// callers or the sliding log. l.mu must be held by the caller.
+func (l *Limiter) lend() {
+	if l.closed || l.draining.Load() || l.head != nil || l.log != nil || l.tokens <= 0 {
+		return
+	}
+	full := l.timeUntil(l.burst)
+	if l.boost > 0 {
+		// The lent tokens must be back before the boost ends.
+		full = min(full, l.boostUntil.Sub(l.lastTime))
+	}
+	if full <= 0 {
+		return
+	}
+	l.fastUntil.Store(int64(l.lastTime.Add(full).Sub(l.epoch)))
+	l.fast.Store(int64(l.tokens))
+	l.tokens = 0
+}
+
+// unlock releases l.mu and then runs the callbacks queued by notify while it
+// was held, so that they are free to call back into the limiter.
+func (l *Limiter) unlock() {
+	if fn := l.onExhaust; fn != nil {
+		// Tokens lent to the fast path are still in the bucket.
+		if exhausted := l.tokens+int(l.fast.Load()) <= 0; exhausted != l.exhausted {
+			l.exhausted = exhausted
+			l.notify(func() { fn(exhausted) })
+		}
+	}
+
+	pending := l.pending
+	l.pending = nil
+	l.mu.Unlock()
+
+	for _, fn := range pending {
+		fn()
+	}
+}
+
+// notify queues fn to run once l.mu is released. l.mu must be held by the
+// caller.
+func (l *Limiter) notify(fn func()) {
+	l.pending = append(l.pending, fn)
+}
+
+// lock acquires l.mu and takes back any tokens lent to the fast path, so that
+// l.tokens is the true count while the lock is held.
+func (l *Limiter) lock() {
 	l.mu.Lock()
-	defer l.mu.Unlock()
+	l.tokens += int(l.fast.Swap(0))
+}
 
-	// How much time has elapsed?
-	now := clock.Now()
-	elapsed := now.Sub(l.lastTime)
+// refill tops up the bucket with the tokens that have accumulated since it was
+// last refilled. l.mu must be held by the caller.
+func (l *Limiter) refill() {
+	// Limiters in a Group are refilled by the group's ticker instead.
+	if l.group != nil {
+		return
+	}
+	l.accrue(l.clock.Now())
+}
+
+// accrue credits the bucket with the tokens that have accumulated up to now.
+// l.mu must be held by the caller.
+func (l *Limiter) accrue(now time.Time) {
+	// How much time has elapsed? Time.Sub uses the monotonic clock readings if
+	// both times have them so this is unaffected by changes to the wall clock.
+	// Without them, a clock that goes backwards leaves the bucket as it was
+	// until the clock catches up, rather than moving lastTime back and
+	// crediting the same period twice when it does.
+	from := l.lastTime
+	elapsed := now.Sub(from)
+	if elapsed < 0 {
+		if fn := l.regressed; fn != nil {
+			l.notify(func() { fn(-elapsed) })
+		}
+		return
+	}
 	l.lastTime = now
+	l.unboost(now)
+
+	// With a sliding window the available tokens are whatever hasn't been
+	// used within the window.
+	if l.log != nil {
+		l.log.evict(now)
+		l.tokens = l.rate - l.log.count
+		return
+	}
 
 	// Put tokens into the bucket, the number proportional to the duration since
-	// last called.
-	l.tokens += int(elapsed.Nanoseconds() * int64(l.rate) / l.window.Nanoseconds())
-	l.tokens = min(l.tokens, l.rate)
+	// last called. Elapsed time that doesn't add up to a whole token is carried
+	// over to the next refill, otherwise frequent callers would be
+	// systematically under-credited. The arithmetic can't overflow, even for
+	// a high rate after days of being idle. Any part of elapsed during the
+	// warmup is credited at the ramped rate instead.
+	warmth, warm, ok := l.warmCredit(from, now)
+	credit, remainder, fits := mulDiv(uint64(elapsed-warm), uint64(l.rate), uint64(l.remainder)+warmth, uint64(l.window))
+	ok = ok && fits
 
-	// If the bucket is exhausted then the caller cannot proceed immediately.
-	if l.tokens <= 0 {
-		return false
+	// A full bucket can't bank partial tokens either.
+	if !ok || credit >= uint64(max(l.burst-l.tokens, 0)) {
+		l.tokens = l.burst
+		l.remainder = 0
+		return
 	}
+	l.tokens += int(credit)
+	l.remainder = int64(remainder)
+}
 
-	// Success, remove a token.
-	l.tokens--
-	return true
+// mulDiv returns the quotient and remainder of (a*b + c) / d, computed without
+// overflowing. It reports false if the quotient doesn't fit in 64 bits.
+func mulDiv(a, b, c, d uint64) (q, r uint64, ok bool) {
+	hi, lo := bits.Mul64(a, b)
+	lo, carry := bits.Add64(lo, c, 0)
+	hi += carry
+	if hi >= d {
+		return 0, 0, false
+	}
+	q, r = bits.Div64(hi, lo, d)
+	return q, r, true
+}
+
+// waitFor returns how long until the bucket will hold at least n tokens,
+// without consuming any.
+func (l *Limiter) waitFor(n int) time.Duration {
+	l.lock()
+	defer l.unlock()
+
+	l.refill()
+	return l.timeUntil(n)
+}
+
+// timeUntil returns how long until the bucket will hold at least n tokens, zero
+// if it already does. l.mu must be held by the caller and the bucket should
+// have just been refilled.
+func (l *Limiter) timeUntil(n int) time.Duration {
+	return l.timeUntilFrac(n, 0)
 }
 
-// clocker defines an interface through which to access time package functions.
-// This exists purely for testing. If testing/synctest lands then hopefully
-// this dance won't be necessary anymore.
-type clocker interface {
+// timeUntilFrac is like timeUntil but for n tokens plus part of one, in the
+// same units as remainder.
+func (l *Limiter) timeUntilFrac(n int, part int64) time.Duration {
+	if l.log != nil {
+		return l.log.timeUntil(l.lastTime, n-l.tokens)
+	}
+
+	need := int64(n - l.tokens)
+	if need < 0 || need == 0 && part <= l.remainder {
+		return 0
+	}
+	if wait, ok := l.warmTimeUntil(float64(need)*float64(l.window) + float64(part) - float64(l.remainder)); ok {
+		return wait
+	}
+
+	// Round up so that the bucket is guaranteed to hold the tokens once the
+	// duration has passed. The credit needed is need*window + part - remainder,
+	// split up to stay positive.
+	window, rate := uint64(l.window), uint64(l.rate)
+	a, c := uint64(need-1), window-uint64(l.remainder)+uint64(part)+rate-1
+	if need == 0 {
+		a, c = 0, uint64(part-l.remainder)+rate-1
+	}
+	wait, _, ok := mulDiv(a, window, c, rate)
+	if !ok || wait > math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(wait)
+}
+
+// Clock defines an interface through which the limiter accesses time package
+// functions. This exists purely for testing, so that the passage of time can be
+// controlled. If testing/synctest lands then hopefully this dance won't be
+// necessary anymore.
+type Clock interface {
+	// Now returns the current time. The limiter measures elapsed time by
+	// subtracting times returned by Now, so they should carry a monotonic
+	// clock reading, as times from time.Now do, for the limiter to be immune
+	// to the wall clock being changed.
 	Now() time.Time
 
 	After(d time.Duration) <-chan time.Time
 }
 
-// The default implementation of clocker just calls the package level functions
+// The default implementation of Clock just calls the package level functions
 type pkgclock struct{}
 
 func (p *pkgclock) Now() time.Time {
@@ -104,6 +1597,64 @@ func (p *pkgclock) After(d time.Duration) <-chan time.Time {
 	return time.After(d)
 }
 
-// This variable holds the clock implementation that will be used in the
-// limiter. It will only be overriden in tests.
-var clock clocker = &pkgclock{}
+func (p *pkgclock) NewTimer(d time.Duration) Timer {
+	return &pkgtimer{t: time.NewTimer(d)}
+}
+
+// A Timer fires once after a duration has passed, like time.Timer. It can be
+// reset to fire again so a caller that waits repeatedly needn't allocate a
+// new one each time.
+type Timer interface {
+	C() <-chan time.Time
+	Reset(d time.Duration) bool
+	Stop() bool
+}
+
+// TimerClock is a Clock that can also create Timers. The limiter uses them,
+// when the Clock provides them, to cut allocations for blocked callers.
+// Otherwise it falls back to After.
+type TimerClock interface {
+	Clock
+
+	NewTimer(d time.Duration) Timer
+}
+
+type pkgtimer struct {
+	t *time.Timer
+}
+
+func (p *pkgtimer) C() <-chan time.Time        { return p.t.C }
+func (p *pkgtimer) Reset(d time.Duration) bool { return p.t.Reset(d) }
+func (p *pkgtimer) Stop() bool                 { return p.t.Stop() }
+
+// afterTimer adapts a Clock that can't create Timers by calling After each time
+// it's reset.
+type afterTimer struct {
+	clock Clock
+	c     <-chan time.Time
+}
+
+func (a *afterTimer) C() <-chan time.Time { return a.c }
+
+func (a *afterTimer) Reset(d time.Duration) bool {
+	a.c = a.clock.After(d)
+	return false
+}
+
+func (a *afterTimer) Stop() bool {
+	a.c = nil
+	return false
+}
+
+// newTimer returns a Timer from l's clock that fires after d, reusing one from
+// an earlier wait if there is one.
+func (l *Limiter) newTimer(d time.Duration) Timer {
+	if t, ok := l.timers.Get().(Timer); ok {
+		t.Reset(d)
+		return t
+	}
+	if tc, ok := l.clock.(TimerClock); ok {
+		return tc.NewTimer(d)
+	}
+	return &afterTimer{clock: l.clock, c: l.clock.After(d)}
+}
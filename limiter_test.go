@@ -2,17 +2,22 @@ package ratelimiter
 
 import (
 	"context"
+	"errors"
+	"math"
+	"math/rand/v2"
+	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 func TestNewLimiter(t *testing.T) {
 	fakeclock := newFakeClock(time.Now())
-	clock = fakeclock
-	t.Cleanup(func() { clock = &pkgclock{} })
 
 	const nt = 5
-	l := New(nt, time.Minute)
+	l := New(nt, time.Minute, WithClock(fakeclock))
 	for range nt {
 		if err := l.Acquire(t.Context()); err != nil {
 			t.Fatalf("Unexpected error on Acquire() - %s", err)
@@ -49,3 +54,2023 @@ func TestContextCancel(t *testing.T) {
 		t.Errorf("Expected context canceled error, got %s", got)
 	}
 }
+
+func TestTryAcquire(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	const nt = 3
+	l := New(nt, time.Minute, WithClock(fakeclock))
+	for i := range nt {
+		if !l.TryAcquire() {
+			t.Fatalf("TryAcquire() %d returned false on a non-empty bucket", i)
+		}
+	}
+
+	// The bucket is drained
+	if l.TryAcquire() {
+		t.Errorf("TryAcquire() returned true on an empty bucket")
+	}
+
+	// Advance the clock by enough time for a single token to accumulate
+	fakeclock.Advance(time.Minute / nt)
+	if !l.TryAcquire() {
+		t.Errorf("TryAcquire() returned false after the bucket refilled")
+	}
+	if l.TryAcquire() {
+		t.Errorf("TryAcquire() returned true but only one token should have refilled")
+	}
+
+	if fakeclock.afterCalled {
+		t.Errorf("TryAcquire() should never block but it did")
+	}
+}
+
+func TestAllowAt(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := New(2, time.Second, WithClock(newFakeClock(start)))
+
+	now := start
+	for i := range 2 {
+		if !l.AllowAt(now) {
+			t.Errorf("AllowAt() %d should succeed on a full bucket", i)
+		}
+	}
+	if l.AllowAt(now) {
+		t.Errorf("AllowAt() should fail on an empty bucket")
+	}
+
+	// Step time forward by hand
+	now = now.Add(499 * time.Millisecond)
+	if l.AllowAt(now) {
+		t.Errorf("AllowAt() should fail before a token has accrued")
+	}
+	now = now.Add(time.Millisecond)
+	if !l.AllowAt(now) {
+		t.Errorf("AllowAt() should succeed once a token has accrued")
+	}
+
+	// The limiter carries on from the last time it was given
+	if l.lastTime != now {
+		t.Errorf("Expected lastTime to be %s, got %s", now, l.lastTime)
+	}
+	if l.AllowAt(now.Add(-time.Hour)) {
+		t.Errorf("AllowAt() shouldn't credit tokens for an earlier time")
+	}
+	if got := l.Snapshot().Tokens; got != 0 {
+		t.Errorf("Expected an empty bucket, has %d", got)
+	}
+}
+
+func TestWouldBlock(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	l := New(2, time.Second, WithClock(fakeclock))
+	if l.WouldBlock() {
+		t.Errorf("WouldBlock() should be false for a full bucket")
+	}
+	if got := l.Tokens(); got != 2 {
+		t.Errorf("WouldBlock() should not consume tokens, have %d", got)
+	}
+
+	l.Drain()
+	if !l.WouldBlock() {
+		t.Errorf("WouldBlock() should be true for an empty bucket")
+	}
+
+	// It accounts for tokens that have accrued since the bucket was drained
+	fakeclock.Advance(500 * time.Millisecond)
+	if l.WouldBlock() {
+		t.Errorf("WouldBlock() should be false once a token has accrued")
+	}
+	if !l.TryAcquire() {
+		t.Errorf("TryAcquire() should take the accrued token")
+	}
+}
+
+func TestTryAcquireN(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	l := New(10, time.Second, WithClock(fakeclock))
+	if !l.TryAcquireN(6) {
+		t.Errorf("TryAcquireN(6) should succeed on a full bucket")
+	}
+
+	// Not enough tokens takes none of them
+	if l.TryAcquireN(5) {
+		t.Errorf("TryAcquireN(5) should fail with 4 tokens")
+	}
+	if got := l.Tokens(); got != 4 {
+		t.Errorf("Expected a failed TryAcquireN() to leave 4 tokens, has %d", got)
+	}
+
+	// Refill happens first, making exactly enough
+	fakeclock.Advance(100 * time.Millisecond)
+	if !l.TryAcquireN(5) {
+		t.Errorf("TryAcquireN(5) should succeed once refilled to 5")
+	}
+	if got := l.Tokens(); got != 0 {
+		t.Errorf("Expected an empty bucket, has %d", got)
+	}
+
+	// More than the burst can never succeed
+	fakeclock.Advance(time.Minute)
+	if l.TryAcquireN(11) {
+		t.Errorf("TryAcquireN(11) should fail with a burst of 10")
+	}
+	if !l.TryAcquireN(0) {
+		t.Errorf("TryAcquireN(0) should always succeed")
+	}
+}
+
+func TestAcquireN(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	const nt = 4
+	l := New(nt, time.Minute, WithClock(fakeclock))
+
+	// Requesting more tokens than the bucket can hold fails straight away
+	if err := l.AcquireN(t.Context(), nt+1); !errors.Is(err, ErrTooManyTokens) {
+		t.Errorf("Expected ErrTooManyTokens, got %v", err)
+	}
+
+	// The whole bucket can be taken in one go
+	if err := l.AcquireN(t.Context(), nt); err != nil {
+		t.Fatalf("Unexpected error on AcquireN() - %s", err)
+	}
+	if fakeclock.afterCalled {
+		t.Errorf("The limiter should not have blocked but it did")
+	}
+
+	// Let a single token refill, which isn't enough for the next request so
+	// the limiter has to wait for the remainder.
+	start := fakeclock.Advance(time.Minute / nt)
+	if err := l.AcquireN(t.Context(), 3); err != nil {
+		t.Fatalf("Unexpected error on AcquireN() - %s", err)
+	}
+	if !fakeclock.afterCalled {
+		t.Errorf("The limiter should have blocked but it did not")
+	}
+	if got, want := fakeclock.Now().Sub(start), 2*time.Minute/nt; got != want {
+		t.Errorf("Expected AcquireN() to wait %s, waited %s", want, got)
+	}
+	if l.tokens != 0 {
+		t.Errorf("Expected the bucket to be empty, has %d tokens", l.tokens)
+	}
+}
+
+func TestTokens(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	const nt = 6
+	l := New(nt, time.Minute, WithClock(fakeclock))
+	if got := l.Tokens(); got != nt {
+		t.Errorf("Expected a new limiter to have %d tokens, has %d", nt, got)
+	}
+
+	if err := l.AcquireN(t.Context(), nt); err != nil {
+		t.Fatalf("Unexpected error on AcquireN() - %s", err)
+	}
+	if got := l.Tokens(); got != 0 {
+		t.Errorf("Expected a drained limiter to have 0 tokens, has %d", got)
+	}
+
+	// Tokens() doesn't consume so asking twice gives the same answer
+	fakeclock.Advance(2 * time.Minute / nt)
+	for range 2 {
+		if got := l.Tokens(); got != 2 {
+			t.Errorf("Expected 2 tokens after refill, has %d", got)
+		}
+	}
+
+	// The bucket never holds more than its capacity
+	fakeclock.Advance(time.Hour)
+	if got := l.Tokens(); got != nt {
+		t.Errorf("Expected the bucket to be capped at %d tokens, has %d", nt, got)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	l := New(5, time.Minute)
+	if l.burst != 5 {
+		t.Errorf("Expected burst to default to the rate, got %d", l.burst)
+	}
+	if _, ok := l.clock.(*pkgclock); !ok {
+		t.Errorf("Expected the default clock to be the time package, got %T", l.clock)
+	}
+	if l.tokens != 5 {
+		t.Errorf("Expected a new limiter to be full, has %d tokens", l.tokens)
+	}
+
+	// Later options override earlier ones
+	fakeclock := newFakeClock(time.Now())
+	l = New(5, time.Minute, WithBurst(2), WithClock(fakeclock), WithBurst(8))
+	if l.burst != 8 {
+		t.Errorf("Expected burst of 8, got %d", l.burst)
+	}
+	if l.clock != fakeclock {
+		t.Errorf("Expected the limiter to use the provided clock")
+	}
+	if l.tokens != 8 {
+		t.Errorf("Expected a new limiter to be filled to the burst, has %d tokens", l.tokens)
+	}
+}
+
+func TestRefillCarriesFractionalTokens(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	const nt = 10
+	l := New(nt, time.Second, WithClock(fakeclock))
+	if err := l.AcquireN(t.Context(), nt); err != nil {
+		t.Fatalf("Unexpected error on AcquireN() - %s", err)
+	}
+
+	// Poll every millisecond for 10 seconds. A single refill never accrues a
+	// whole token, but over the whole period exactly rate/window should have.
+	var granted int
+	for range 10_000 {
+		fakeclock.Advance(time.Millisecond)
+		if l.TryAcquire() {
+			granted++
+		}
+	}
+	if want := 10 * nt; granted != want {
+		t.Errorf("Expected %d tokens to be granted, got %d", want, granted)
+	}
+}
+
+func TestBurst(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	// 2 tokens a second steady state, but allow bursts of up to 6
+	l := New(2, time.Second, WithBurst(6), WithClock(fakeclock))
+	for range 6 {
+		if !l.TryAcquire() {
+			t.Fatalf("Expected the full burst to be available")
+		}
+	}
+	if l.TryAcquire() {
+		t.Fatalf("Expected the bucket to be empty after the burst")
+	}
+
+	// Refill happens at the steady rate, not the burst size
+	fakeclock.Advance(time.Second)
+	if got := l.Tokens(); got != 2 {
+		t.Errorf("Expected 2 tokens after a second, has %d", got)
+	}
+
+	// Blocking waits are paced by the steady rate
+	start := fakeclock.Now()
+	if err := l.AcquireN(t.Context(), 3); err != nil {
+		t.Fatalf("Unexpected error on AcquireN() - %s", err)
+	}
+	if got, want := fakeclock.Now().Sub(start), 500*time.Millisecond; got != want {
+		t.Errorf("Expected AcquireN() to wait %s, waited %s", want, got)
+	}
+
+	// After a long idle period the bucket is capped at the burst size
+	fakeclock.Advance(time.Hour)
+	if got := l.Tokens(); got != 6 {
+		t.Errorf("Expected the bucket to be capped at 6 tokens, has %d", got)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	const nt = 4
+	l := New(nt, time.Second, WithClock(fakeclock))
+	for range nt {
+		if wait, ok := l.Reserve(); !ok || wait != 0 {
+			t.Fatalf("Expected an immediate reservation, got %s, %t", wait, ok)
+		}
+	}
+
+	// The bucket is empty, so reservations stack up one token interval apart
+	for i := 1; i <= 3; i++ {
+		wait, ok := l.Reserve()
+		if !ok {
+			t.Fatalf("Reserve() %d failed", i)
+		}
+		if want := time.Duration(i) * time.Second / nt; wait != want {
+			t.Errorf("Expected reservation %d to wait %s, got %s", i, want, wait)
+		}
+	}
+	if got := l.Tokens(); got != -3 {
+		t.Errorf("Expected 3 outstanding reservations, Tokens() returned %d", got)
+	}
+
+	// Time passing pays back the reservations
+	fakeclock.Advance(time.Second / 2)
+	if wait, _ := l.Reserve(); wait != 2*time.Second/nt {
+		t.Errorf("Expected reservation to wait %s, got %s", 2*time.Second/nt, wait)
+	}
+
+	// An Acquire has to wait behind the reservations
+	if l.TryAcquire() {
+		t.Errorf("TryAcquire() should not jump ahead of reservations")
+	}
+
+	if _, ok := New(1, time.Second, WithBurst(0)).Reserve(); ok {
+		t.Errorf("Reserve() should fail when the bucket can't hold a token")
+	}
+}
+
+func TestReserveN(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	l := New(10, time.Second, WithClock(fakeclock))
+	now := fakeclock.Now()
+	if ready, ok := l.ReserveN(4); !ok || !ready.Equal(now) {
+		t.Errorf("Expected a full bucket to be ready now, got %s, %t", ready, ok)
+	}
+
+	// Stacked reservations are spaced by n*window/rate
+	l.Drain()
+	for i := 1; i <= 3; i++ {
+		ready, ok := l.ReserveN(2)
+		if !ok {
+			t.Fatalf("ReserveN(2) %d failed", i)
+		}
+		if got, want := ready.Sub(now), time.Duration(i)*200*time.Millisecond; got != want {
+			t.Errorf("Expected reservation %d to be ready in %s, got %s", i, want, got)
+		}
+	}
+
+	// More than the burst can never be reserved
+	if _, ok := l.ReserveN(11); ok {
+		t.Errorf("ReserveN(11) should fail with a burst of 10")
+	}
+	if got := l.Tokens(); got != -6 {
+		t.Errorf("Expected a failed ReserveN() to reserve nothing, has %d tokens", got)
+	}
+}
+
+func TestDeadlineBeforeNextToken(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	l := New(1, time.Minute, WithClock(fakeclock))
+	if err := l.Acquire(t.Context()); err != nil {
+		t.Fatalf("Unexpected error on Acquire() - %s", err)
+	}
+
+	// The next token is a minute away but the context expires well before then
+	ctx, cancel := context.WithDeadline(t.Context(), fakeclock.Now().Add(time.Second))
+	defer cancel()
+	if err := l.Acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if fakeclock.afterCalled {
+		t.Errorf("The limiter should have failed fast rather than blocking")
+	}
+}
+
+func TestAllow(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	l := New(2, time.Second, WithClock(fakeclock))
+	for range 2 {
+		if !l.Allow() {
+			t.Fatalf("Allow() returned false on a non-empty bucket")
+		}
+	}
+	if got := l.Tokens(); got != 0 {
+		t.Errorf("Expected Allow() to consume tokens, %d remain", got)
+	}
+	if l.Allow() {
+		t.Errorf("Allow() returned true on an empty bucket")
+	}
+
+	fakeclock.Advance(time.Second / 2)
+	if !l.Allow() {
+		t.Errorf("Allow() returned false after the bucket refilled")
+	}
+}
+
+func TestClose(t *testing.T) {
+	l := New(1, time.Hour)
+	if err := l.Acquire(t.Context()); err != nil {
+		t.Fatalf("Unexpected error on Acquire() - %s", err)
+	}
+
+	// Block on an empty bucket and check that Close wakes the waiter
+	errc := make(chan error)
+	go func() {
+		errc <- l.Acquire(t.Context())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := l.Close(); err != nil {
+		t.Fatalf("Unexpected error on Close() - %s", err)
+	}
+	select {
+	case err := <-errc:
+		if !errors.Is(err, ErrClosed) {
+			t.Errorf("Expected ErrClosed for a blocked waiter, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Close() did not wake the blocked waiter")
+	}
+
+	// Later calls fail fast, even once tokens would be available
+	l.mu.Lock()
+	l.tokens = l.burst
+	l.mu.Unlock()
+	if err := l.Acquire(t.Context()); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed after Close(), got %v", err)
+	}
+	if l.TryAcquire() {
+		t.Errorf("TryAcquire() should fail after Close()")
+	}
+	if err := l.Close(); err != nil {
+		t.Errorf("Closing twice should not fail, got %s", err)
+	}
+}
+
+func TestAcquireRemaining(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	l := New(3, time.Second, WithClock(fakeclock))
+	for want := 2; want >= 0; want-- {
+		got, err := l.AcquireRemaining(t.Context())
+		if err != nil {
+			t.Fatalf("Unexpected error on AcquireRemaining() - %s", err)
+		}
+		if got != want {
+			t.Errorf("Expected %d tokens to remain, got %d", want, got)
+		}
+	}
+
+	// An empty bucket waits for the next token, leaving nothing behind
+	got, err := l.AcquireRemaining(t.Context())
+	if err != nil {
+		t.Fatalf("Unexpected error on AcquireRemaining() - %s", err)
+	}
+	if !fakeclock.afterCalled {
+		t.Errorf("AcquireRemaining() should have waited for a token")
+	}
+	if got != 0 {
+		t.Errorf("Expected no tokens to remain, got %d", got)
+	}
+	if got := l.Tokens(); got != 0 {
+		t.Errorf("Expected Tokens() to agree, got %d", got)
+	}
+}
+
+func TestWait(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	l := New(2, time.Second, WithClock(fakeclock))
+	l.Drain()
+	start := fakeclock.Now()
+	l.Wait()
+	if got := fakeclock.Now().Sub(start); got != 500*time.Millisecond {
+		t.Errorf("Expected Wait() to return after 500ms, waited %s", got)
+	}
+	if got := l.Tokens(); got != 0 {
+		t.Errorf("Expected Wait() to take the token, has %d", got)
+	}
+}
+
+func TestAcquireChan(t *testing.T) {
+	l := New(1, time.Hour)
+	done := make(chan struct{})
+	if err := l.AcquireChan(done); err != nil {
+		t.Fatalf("Unexpected error on AcquireChan() - %s", err)
+	}
+
+	// Closing the channel while blocked gives up
+	errc := make(chan error)
+	go func() {
+		errc <- l.AcquireChan(done)
+	}()
+	for l.numBlocked.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(done)
+	if err := <-errc; !errors.Is(err, ErrCanceled) {
+		t.Errorf("Expected ErrCanceled, got %v", err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	// The waiter's token arrives shortly, so the shutdown can drain it
+	l := New(10, time.Second)
+	l.Drain()
+	errc := make(chan error)
+	go func() {
+		errc <- l.Acquire(t.Context())
+	}()
+	for l.numBlocked.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- l.Shutdown(t.Context())
+	}()
+	for !l.draining.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	if err := l.Acquire(t.Context()); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed for a new Acquire() during Shutdown(), got %v", err)
+	}
+	if l.TryAcquire() {
+		t.Errorf("TryAcquire() should fail during Shutdown()")
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("Expected the existing waiter to get its token, got %v", err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Unexpected error on Shutdown() - %s", err)
+	}
+	if err := l.Acquire(t.Context()); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed after Shutdown(), got %v", err)
+	}
+
+	// A waiter that won't get a token in time is woken when the shutdown
+	// context expires.
+	l = New(1, time.Hour)
+	l.Drain()
+	go func() {
+		errc <- l.Acquire(t.Context())
+	}()
+	for l.numBlocked.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(t.Context(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected Shutdown() to give up with context.DeadlineExceeded, got %v", err)
+	}
+	if err := <-errc; !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed for the abandoned waiter, got %v", err)
+	}
+}
+
+func TestNewPer(t *testing.T) {
+	for _, tc := range []struct {
+		l      *Limiter
+		window time.Duration
+	}{
+		{NewPerSecond(5), time.Second},
+		{NewPerMinute(5), time.Minute},
+		{NewPerHour(5), time.Hour},
+	} {
+		if got := tc.l.Rate(); got != 5 {
+			t.Errorf("Expected a rate of 5, got %d", got)
+		}
+		if got := tc.l.Window(); got != tc.window {
+			t.Errorf("Expected a window of %s, got %s", tc.window, got)
+		}
+	}
+
+	// Options are passed through
+	if l := NewPerMinute(60, WithBurst(1)); l.burst != 1 {
+		t.Errorf("Expected a burst of 1, got %d", l.burst)
+	}
+}
+
+func TestNewChecked(t *testing.T) {
+	tests := []struct {
+		rate   int
+		window time.Duration
+		want   error
+	}{
+		{10, time.Minute, nil},
+		{0, time.Minute, ErrInvalidRate},
+		{-1, time.Minute, ErrInvalidRate},
+		{10, 0, ErrInvalidWindow},
+		{10, -time.Second, ErrInvalidWindow},
+	}
+	for _, tt := range tests {
+		l, err := NewChecked(tt.rate, tt.window)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("NewChecked(%d, %s) returned error %v, want %v", tt.rate, tt.window, err, tt.want)
+		}
+		if (l == nil) != (tt.want != nil) {
+			t.Errorf("NewChecked(%d, %s) returned limiter %v", tt.rate, tt.window, l)
+		}
+	}
+}
+
+func TestZeroWindow(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	l := New(10, time.Second, WithClock(fakeclock))
+	l.Drain()
+	l.window = 0 // as if set by reflection, or a setter that doesn't validate
+
+	if err := l.Acquire(t.Context()); !errors.Is(err, ErrInvalidWindow) {
+		t.Errorf("Expected ErrInvalidWindow from Acquire(), got %v", err)
+	}
+	if l.TryAcquire() {
+		t.Errorf("TryAcquire() should fail with a zero window")
+	}
+
+	l = New(10, 0)
+	if err := l.AcquireN(t.Context(), 2); !errors.Is(err, ErrInvalidWindow) {
+		t.Errorf("Expected ErrInvalidWindow from AcquireN(), got %v", err)
+	}
+}
+
+func TestWaitError(t *testing.T) {
+	l := New(1, time.Hour)
+	if err := l.Acquire(t.Context()); err != nil {
+		t.Fatalf("Unexpected error on Acquire() - %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	err := l.Acquire(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the error to wrap context.Canceled, got %v", err)
+	}
+	var we *WaitError
+	if !errors.As(err, &we) {
+		t.Fatalf("Expected a *WaitError, got %T", err)
+	}
+	if we.Waited < 20*time.Millisecond {
+		t.Errorf("Expected to have waited at least 20ms, waited %s", we.Waited)
+	}
+
+	// Failing fast on a deadline is reported without any wait
+	ctx, cancel = context.WithTimeout(t.Context(), time.Millisecond)
+	defer cancel()
+	err = l.Acquire(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) || !errors.As(err, &we) {
+		t.Fatalf("Expected a *WaitError wrapping context.DeadlineExceeded, got %v", err)
+	}
+	if we.Waited > 10*time.Millisecond {
+		t.Errorf("Expected to fail fast, waited %s", we.Waited)
+	}
+}
+
+func TestSetRate(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	l := New(10, time.Second, WithClock(fakeclock))
+	if err := l.AcquireN(t.Context(), 10); err != nil {
+		t.Fatalf("Unexpected error on AcquireN() - %s", err)
+	}
+
+	// Slow the limiter down, acquires should now be 500ms apart
+	l.SetRate(2, time.Second)
+	for range 3 {
+		start := fakeclock.Now()
+		if err := l.Acquire(t.Context()); err != nil {
+			t.Fatalf("Unexpected error on Acquire() - %s", err)
+		}
+		if got, want := fakeclock.Now().Sub(start), 500*time.Millisecond; got != want {
+			t.Errorf("Expected Acquire() to wait %s, waited %s", want, got)
+		}
+	}
+
+	// The burst follows the rate as it wasn't set explicitly
+	fakeclock.Advance(time.Hour)
+	if got := l.Tokens(); got != 2 {
+		t.Errorf("Expected the bucket to hold 2 tokens, has %d", got)
+	}
+
+	// But an explicit burst is kept
+	l = New(10, time.Second, WithBurst(20), WithClock(fakeclock))
+	l.SetRate(5, time.Second)
+	if got := l.Tokens(); got != 20 {
+		t.Errorf("Expected an explicit burst to survive SetRate(), has %d tokens", got)
+	}
+	if err := l.AcquireN(t.Context(), 20); err != nil {
+		t.Fatalf("Unexpected error on AcquireN() - %s", err)
+	}
+	fakeclock.Advance(time.Second)
+	if got := l.Tokens(); got != 5 {
+		t.Errorf("Expected 5 tokens after refilling at the new rate, has %d", got)
+	}
+}
+
+func TestSetBurst(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	// Lowering the burst of a full bucket discards the excess
+	l := New(10, time.Second, WithClock(fakeclock))
+	l.SetBurst(4)
+	if got := l.Tokens(); got != 4 {
+		t.Errorf("Expected the bucket to be clamped to 4 tokens, has %d", got)
+	}
+	fakeclock.Advance(time.Second)
+	if got := l.Tokens(); got != 4 {
+		t.Errorf("Expected the bucket to fill to no more than 4 tokens, has %d", got)
+	}
+
+	// Raising it makes room for more to accumulate
+	l.SetBurst(20)
+	if got := l.Tokens(); got != 4 {
+		t.Errorf("Expected raising the burst not to add tokens, has %d", got)
+	}
+	fakeclock.Advance(time.Second)
+	if got := l.Tokens(); got != 14 {
+		t.Errorf("Expected 14 tokens a second later, has %d", got)
+	}
+	fakeclock.Advance(time.Minute)
+	if got := l.Tokens(); got != 20 {
+		t.Errorf("Expected the bucket to fill to the new burst of 20, has %d", got)
+	}
+
+	// The burst is now fixed, so a new rate leaves it alone
+	l.SetRate(5, time.Second)
+	if l.burst != 20 {
+		t.Errorf("Expected SetRate() to keep a burst set by SetBurst(), got %d", l.burst)
+	}
+
+	// No effect with a sliding window
+	l = New(10, time.Second, WithClock(fakeclock), WithAlgorithm(SlidingWindow))
+	l.SetBurst(4)
+	if got := l.Tokens(); got != 10 {
+		t.Errorf("Expected SetBurst() to have no effect on a sliding window, has %d tokens", got)
+	}
+}
+
+func TestBoostUntil(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	l := New(2, time.Second, WithClock(fakeclock))
+	l.BoostUntil(3, fakeclock.Now().Add(10*time.Second))
+	if got := l.Tokens(); got != 2 {
+		t.Errorf("Expected the boost not to add tokens straight away, have %d", got)
+	}
+
+	// The extra room fills up at the usual rate
+	fakeclock.Advance(5 * time.Second)
+	var got int
+	for l.TryAcquire() {
+		got++
+	}
+	if got != 5 {
+		t.Errorf("Expected 5 tokens during the boost, got %d", got)
+	}
+
+	// Once it's over the bucket is back to its normal capacity
+	fakeclock.Advance(10 * time.Second)
+	if got := l.Tokens(); got != 2 {
+		t.Errorf("Expected 2 tokens after the boost, have %d", got)
+	}
+	if err := l.AcquireN(t.Context(), 3); !errors.Is(err, ErrTooManyTokens) {
+		t.Errorf("Expected ErrTooManyTokens after the boost, got %v", err)
+	}
+}
+
+func TestSetRateSlidingWindow(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	l := New(4, time.Second, WithAlgorithm(SlidingWindow), WithClock(fakeclock))
+	if err := l.AcquireN(t.Context(), 3); err != nil {
+		t.Fatalf("Unexpected error on AcquireN() - %s", err)
+	}
+
+	l.SetRate(2, time.Second)
+	if got := l.Tokens(); got != 0 {
+		t.Errorf("Expected no room in the shrunken window, has %d tokens", got)
+	}
+	l.SetRate(8, time.Second)
+	if got := l.Tokens(); got != 6 {
+		t.Errorf("Expected 6 free slots in the enlarged window, has %d tokens", got)
+	}
+}
+
+func TestRateAndWindow(t *testing.T) {
+	l := New(10, time.Minute)
+	if got := l.Rate(); got != 10 {
+		t.Errorf("Expected Rate() to be 10, got %d", got)
+	}
+	if got := l.Window(); got != time.Minute {
+		t.Errorf("Expected Window() to be %s, got %s", time.Minute, got)
+	}
+
+	l.SetRate(3, time.Second)
+	if got := l.Rate(); got != 3 {
+		t.Errorf("Expected Rate() to be 3 after SetRate(), got %d", got)
+	}
+	if got := l.Window(); got != time.Second {
+		t.Errorf("Expected Window() to be %s after SetRate(), got %s", time.Second, got)
+	}
+}
+
+func TestPerSecond(t *testing.T) {
+	for _, tc := range []struct {
+		rate   int
+		window time.Duration
+		want   float64
+	}{
+		{10, time.Second, 10},
+		{30, time.Minute, 0.5},
+		{1, time.Hour, 1.0 / 3600},
+		{5, 100 * time.Millisecond, 50},
+		{1, 250 * time.Microsecond, 4000},
+	} {
+		if got := New(tc.rate, tc.window).PerSecond(); math.Abs(got-tc.want) > 1e-9 {
+			t.Errorf("PerSecond() for %d/%s: expected %g, got %g", tc.rate, tc.window, tc.want, got)
+		}
+	}
+
+	// Follows changes to the rate
+	l := New(10, time.Second)
+	l.SetRate(3, 2*time.Second)
+	if got := l.PerSecond(); got != 1.5 {
+		t.Errorf("Expected PerSecond() to be 1.5 after SetRate(), got %g", got)
+	}
+}
+
+func TestAcquireWait(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	l := New(2, time.Second, WithClock(fakeclock))
+	if err := l.AcquireN(t.Context(), 2); err != nil {
+		t.Fatalf("Unexpected error on AcquireN() - %s", err)
+	}
+
+	// The next token is 500ms away, which is too long to wait
+	if err := l.AcquireWait(t.Context(), 100*time.Millisecond); !errors.Is(err, ErrWouldBlockTooLong) {
+		t.Errorf("Expected ErrWouldBlockTooLong, got %v", err)
+	}
+	if fakeclock.afterCalled {
+		t.Errorf("AcquireWait() should have given up without blocking")
+	}
+
+	// But fits within a larger budget
+	start := fakeclock.Now()
+	if err := l.AcquireWait(t.Context(), time.Second); err != nil {
+		t.Fatalf("Unexpected error on AcquireWait() - %s", err)
+	}
+	if got, want := fakeclock.Now().Sub(start), 500*time.Millisecond; got != want {
+		t.Errorf("Expected AcquireWait() to wait %s, waited %s", want, got)
+	}
+
+	// Cancellation still applies
+	ctx, cancel := context.WithDeadline(t.Context(), fakeclock.Now().Add(time.Millisecond))
+	defer cancel()
+	if err := l.AcquireWait(ctx, time.Second); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestAcquireWaitQueued(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  Option
+	}{
+		{"FIFO", WithFairness(FIFO)},
+		{"LeakyBucket", WithAlgorithm(LeakyBucket)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeclock := newFakeClock(time.Now())
+
+			// A token every 500ms, with the bucket empty and a caller already
+			// queued ahead for another.
+			l := New(2, time.Second, tt.opt, WithClock(fakeclock))
+			l.Drain()
+			head := l.enqueue(0, 1)
+
+			// Alone the token would be 500ms away but it's a second with the
+			// queue, so give up straight away rather than waiting in line. The
+			// timeout is a backstop in case it doesn't.
+			ctx, cancel := context.WithTimeout(t.Context(), time.Second)
+			defer cancel()
+			if err := l.AcquireWait(ctx, 600*time.Millisecond); !errors.Is(err, ErrWouldBlockTooLong) {
+				t.Errorf("Expected ErrWouldBlockTooLong, got %v", err)
+			}
+
+			// Likewise for a context that will expire first.
+			dctx, dcancel := context.WithDeadline(t.Context(), fakeclock.Now().Add(600*time.Millisecond))
+			defer dcancel()
+			if err := l.AcquireWait(dctx, time.Minute); !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+			}
+			if dctx.Err() != nil {
+				t.Errorf("AcquireWait() should have given up without waiting in the queue")
+			}
+
+			// Once the queue is clear the same wait fits.
+			l.dequeue(head)
+			start := fakeclock.Now()
+			if err := l.AcquireWait(t.Context(), 600*time.Millisecond); err != nil {
+				t.Fatalf("Unexpected error on AcquireWait() - %s", err)
+			}
+			if got, want := fakeclock.Now().Sub(start), 500*time.Millisecond; got != want {
+				t.Errorf("Expected AcquireWait() to wait %s, waited %s", want, got)
+			}
+		})
+	}
+}
+
+func TestFailedPollsDontDiscardTime(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	const nt = 3
+	l := New(nt, time.Second, WithBurst(10), WithClock(fakeclock))
+	if err := l.AcquireN(t.Context(), 10); err != nil {
+		t.Fatalf("Unexpected error on AcquireN() - %s", err)
+	}
+
+	// Repeatedly ask for more tokens than will be available so every poll fails.
+	// Each failure must not throw away the time that has accrued so far.
+	for elapsed := time.Duration(0); elapsed < time.Second; elapsed += 7 * time.Millisecond {
+		if _, err := l.take(nt+1, nil); err != errNotReady {
+			t.Fatalf("Expected take() to fail with errNotReady, got %v", err)
+		}
+		fakeclock.Advance(7 * time.Millisecond)
+	}
+	if got := l.Tokens(); got != nt {
+		t.Errorf("Expected the bucket to have refilled to %d tokens, has %d", nt, got)
+	}
+}
+
+func TestAcquireNCost(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	l := New(5, time.Second, WithClock(fakeclock))
+	tests := []struct {
+		cost, remaining int
+	}{
+		{0, 5},
+		{-1, 5},
+		{1, 4},
+		{3, 1},
+	}
+	for _, tt := range tests {
+		if err := l.AcquireN(t.Context(), tt.cost); err != nil {
+			t.Fatalf("Unexpected error on AcquireN(%d) - %s", tt.cost, err)
+		}
+		if got := l.Tokens(); got != tt.remaining {
+			t.Errorf("Expected %d tokens after AcquireN(%d), has %d", tt.remaining, tt.cost, got)
+		}
+	}
+
+	// Free work proceeds even when the bucket is in debt
+	if _, ok := l.Reserve(); !ok {
+		t.Fatalf("Reserve() failed")
+	}
+	l.Reserve()
+	if err := l.AcquireN(t.Context(), 0); err != nil {
+		t.Fatalf("Unexpected error on AcquireN(0) - %s", err)
+	}
+	if fakeclock.afterCalled {
+		t.Errorf("AcquireN(0) should never block")
+	}
+}
+
+func TestDrainAndReset(t *testing.T) {
+	for _, a := range []Algorithm{TokenBucket, SlidingWindow} {
+		fakeclock := newFakeClock(time.Now())
+		l := New(3, time.Second, WithAlgorithm(a), WithClock(fakeclock))
+
+		l.Drain()
+		if err := l.Acquire(t.Context()); err != nil {
+			t.Fatalf("Unexpected error on Acquire() - %s", err)
+		}
+		if !fakeclock.afterCalled {
+			t.Errorf("Algorithm %d: Acquire() should block after Drain()", a)
+		}
+
+		l.Reset()
+		fakeclock.afterCalled = false
+		if err := l.AcquireN(t.Context(), 3); err != nil {
+			t.Fatalf("Unexpected error on AcquireN() - %s", err)
+		}
+		if fakeclock.afterCalled {
+			t.Errorf("Algorithm %d: a full burst should be available after Reset()", a)
+		}
+	}
+}
+
+func TestPenalize(t *testing.T) {
+	for _, penalty := range []int{0, 2, 5} {
+		fakeclock := newFakeClock(time.Now())
+		l := New(10, time.Second, WithClock(fakeclock))
+
+		l.Drain()
+		l.Penalize(penalty)
+		waited, err := l.AcquireTimed(t.Context())
+		if err != nil {
+			t.Fatalf("Unexpected error on AcquireTimed() - %s", err)
+		}
+
+		// Each token of penalty adds a token's worth of wait
+		if want := time.Duration(penalty+1) * 100 * time.Millisecond; waited != want {
+			t.Errorf("Expected a penalty of %d to wait %s, waited %s", penalty, want, waited)
+		}
+	}
+
+	// The debt is bounded like any other
+	l := New(10, time.Second, WithClock(newFakeClock(time.Now())))
+	l.Penalize(1000)
+	if got := l.Tokens(); got != -10 {
+		t.Errorf("Expected the penalty to stop at -10 tokens, have %d", got)
+	}
+}
+
+func TestAcquireTimed(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	l := New(4, time.Second, WithClock(fakeclock))
+	waited, err := l.AcquireTimed(t.Context())
+	if err != nil {
+		t.Fatalf("Unexpected error on AcquireTimed() - %s", err)
+	}
+	if waited != 0 {
+		t.Errorf("Expected no wait from a full bucket, waited %s", waited)
+	}
+
+	l.Drain()
+	start := fakeclock.Now()
+	waited, err = l.AcquireTimed(t.Context())
+	if err != nil {
+		t.Fatalf("Unexpected error on AcquireTimed() - %s", err)
+	}
+	if advanced := fakeclock.Now().Sub(start); waited != advanced {
+		t.Errorf("Expected the reported wait %s to match the clock's advance %s", waited, advanced)
+	}
+	if waited != 250*time.Millisecond {
+		t.Errorf("Expected to wait 250ms, waited %s", waited)
+	}
+}
+
+func TestWaitIsExact(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	l := New(4, time.Second, WithClock(fakeclock))
+	l.Drain()
+
+	// Waiting for several tokens is a single sleep rather than one per token
+	start := fakeclock.Now()
+	if err := l.AcquireN(t.Context(), 3); err != nil {
+		t.Fatalf("Unexpected error on AcquireN() - %s", err)
+	}
+	if fakeclock.afterCount != 1 {
+		t.Errorf("Expected AcquireN() to wake once, woke %d times", fakeclock.afterCount)
+	}
+	if got, want := fakeclock.Now().Sub(start), 750*time.Millisecond; got != want {
+		t.Errorf("Expected AcquireN() to wait %s, waited %s", want, got)
+	}
+
+	// With a partially accrued token only the remainder is waited for
+	fakeclock.Advance(100 * time.Millisecond)
+	start = fakeclock.Now()
+	if err := l.Acquire(t.Context()); err != nil {
+		t.Fatalf("Unexpected error on Acquire() - %s", err)
+	}
+	if fakeclock.afterCount != 2 {
+		t.Errorf("Expected Acquire() to wake once, woke %d times", fakeclock.afterCount-1)
+	}
+	if got, want := fakeclock.Now().Sub(start), 150*time.Millisecond; got != want {
+		t.Errorf("Expected Acquire() to wait %s, waited %s", want, got)
+	}
+}
+
+func TestAcquireUpTo(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	l := New(5, time.Second, WithClock(fakeclock))
+	if got := l.AcquireUpTo(3); got != 3 {
+		t.Errorf("Expected to get all 3 tokens from a full bucket, got %d", got)
+	}
+	if got := l.AcquireUpTo(10); got != 2 {
+		t.Errorf("Expected to get the 2 remaining tokens, got %d", got)
+	}
+	if got := l.AcquireUpTo(10); got != 0 {
+		t.Errorf("Expected to get no tokens from an empty bucket, got %d", got)
+	}
+
+	// Refill happens before tokens are handed out
+	fakeclock.Advance(600 * time.Millisecond)
+	if got := l.AcquireUpTo(10); got != 3 {
+		t.Errorf("Expected to get the 3 refilled tokens, got %d", got)
+	}
+	if fakeclock.afterCalled {
+		t.Errorf("AcquireUpTo() should never block")
+	}
+}
+
+func TestString(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	l := New(10, time.Minute, WithClock(fakeclock))
+	if err := l.AcquireN(t.Context(), 3); err != nil {
+		t.Fatalf("Unexpected error on AcquireN() - %s", err)
+	}
+	if got, want := l.String(), "Limiter(rate=10/1m0s, tokens=7)"; got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
+
+func TestNewEvery(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	l := NewEvery(2*time.Second, 3, WithClock(fakeclock))
+	if err := l.AcquireN(t.Context(), 3); err != nil {
+		t.Fatalf("Unexpected error on AcquireN() - %s", err)
+	}
+
+	// A token arrives every interval, and not before
+	for range 3 {
+		fakeclock.Advance(2*time.Second - time.Nanosecond)
+		if l.TryAcquire() {
+			t.Fatalf("TryAcquire() succeeded before the interval had passed")
+		}
+		fakeclock.Advance(time.Nanosecond)
+		if !l.TryAcquire() {
+			t.Fatalf("TryAcquire() failed once the interval had passed")
+		}
+	}
+
+	// Accumulation is capped at the burst
+	fakeclock.Advance(time.Hour)
+	if got := l.Tokens(); got != 3 {
+		t.Errorf("Expected the bucket to be capped at 3 tokens, has %d", got)
+	}
+}
+
+func TestLastRefill(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+	start := fakeclock.Now()
+
+	l := New(2, time.Second, WithClock(fakeclock))
+	if got := l.LastRefill(); !got.Equal(start) {
+		t.Errorf("Expected a new limiter to have last refilled at %s, got %s", start, got)
+	}
+
+	// Asking doesn't count as a refill
+	fakeclock.Advance(time.Minute)
+	if got := l.LastRefill(); !got.Equal(start) {
+		t.Errorf("Expected LastRefill() not to refill, got %s", got)
+	}
+
+	if err := l.Acquire(t.Context()); err != nil {
+		t.Fatalf("Unexpected error on Acquire() - %s", err)
+	}
+
+	// The remaining token was set aside for the fast path, which takes it
+	// without refilling
+	fakeclock.Advance(100 * time.Millisecond)
+	if !l.TryAcquire() {
+		t.Fatalf("Expected TryAcquire() to take the remaining token")
+	}
+	if got, want := l.LastRefill(), start.Add(time.Minute); !got.Equal(want) {
+		t.Errorf("Expected Acquire() to refill at %s and the fast path not to, got %s", want, got)
+	}
+}
+
+func TestTimeToNext(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	l := New(4, time.Second, WithClock(fakeclock))
+	if got := l.TimeToNext(); got != 0 {
+		t.Errorf("Expected no wait with a full bucket, got %s", got)
+	}
+
+	l.Drain()
+	if got := l.TimeToNext(); got != 250*time.Millisecond {
+		t.Errorf("Expected a 250ms wait with an empty bucket, got %s", got)
+	}
+	fakeclock.Advance(100 * time.Millisecond)
+	if got := l.TimeToNext(); got != 150*time.Millisecond {
+		t.Errorf("Expected a 150ms wait after partial refill, got %s", got)
+	}
+
+	// Peeking doesn't consume anything
+	fakeclock.Advance(150 * time.Millisecond)
+	for range 2 {
+		if got := l.TimeToNext(); got != 0 {
+			t.Errorf("Expected no wait once a token has refilled, got %s", got)
+		}
+	}
+	if got := l.Tokens(); got != 1 {
+		t.Errorf("Expected TimeToNext() not to consume, has %d tokens", got)
+	}
+}
+
+func TestUnevenIntervalDoesNotDrift(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	// A third of a second isn't a whole number of nanoseconds
+	l := New(3, time.Second, WithClock(fakeclock))
+	l.Drain()
+
+	start := fakeclock.Now()
+	const windows = 1000
+	for range 3 * windows {
+		if err := l.Acquire(t.Context()); err != nil {
+			t.Fatalf("Unexpected error on Acquire() - %s", err)
+		}
+	}
+
+	// Rounding each wait up to the nearest nanosecond is fine, but the error
+	// must not accumulate across waits.
+	drift := fakeclock.Now().Sub(start) - windows*time.Second
+	if drift < 0 || drift > time.Microsecond {
+		t.Errorf("Expected %d acquires to take %s, drifted by %s", 3*windows, windows*time.Second, drift)
+	}
+}
+
+func TestMaxWaiters(t *testing.T) {
+	const max = 3
+	l := New(1, time.Hour, WithMaxWaiters(max))
+	l.Drain()
+
+	errc := make(chan error, max)
+	for range max {
+		go func() {
+			errc <- l.Acquire(t.Context())
+		}()
+	}
+	for l.numBlocked.Load() < max {
+		time.Sleep(time.Millisecond)
+	}
+
+	// No room for anyone else to wait
+	for range 2 {
+		if err := l.Acquire(t.Context()); !errors.Is(err, ErrTooManyWaiters) {
+			t.Errorf("Expected ErrTooManyWaiters, got %v", err)
+		}
+	}
+
+	// Releasing the waiters frees up their slots
+	l.Close()
+	for range max {
+		if err := <-errc; !errors.Is(err, ErrClosed) {
+			t.Errorf("Expected blocked waiters to get ErrClosed, got %v", err)
+		}
+	}
+	if got := l.numBlocked.Load(); got != 0 {
+		t.Errorf("Expected no blocked waiters to be counted, have %d", got)
+	}
+}
+
+func TestRunLimited(t *testing.T) {
+	l := New(1, time.Hour)
+
+	errFn := errors.New("fn failed")
+	var runs int
+	fn := func() error {
+		runs++
+		return errFn
+	}
+	if err := l.RunLimited(t.Context(), fn); !errors.Is(err, errFn) {
+		t.Errorf("Expected the error from fn, got %v", err)
+	}
+	if runs != 1 {
+		t.Errorf("Expected fn to run once, ran %d times", runs)
+	}
+
+	// The bucket is empty, cancel while waiting and fn shouldn't run
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	if err := l.RunLimited(ctx, fn); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if runs != 1 {
+		t.Errorf("Expected fn not to run after cancel, ran %d times", runs)
+	}
+}
+
+// taskGroup is a minimal stand in for errgroup.Group.
+type taskGroup struct {
+	wg   sync.WaitGroup
+	mu   sync.Mutex
+	errs []error
+}
+
+func (g *taskGroup) Go(fn func() error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		if err := fn(); err != nil {
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			g.errs = append(g.errs, err)
+		}
+	}()
+}
+
+func TestGo(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+	start := fakeclock.Now()
+
+	l := New(2, time.Second, WithClock(fakeclock))
+	g := &taskGroup{}
+	var (
+		starts []time.Duration
+		ran    atomic.Int64
+	)
+	for range 6 {
+		l.Go(t.Context(), g, func() error {
+			ran.Add(1)
+			return nil
+		})
+		starts = append(starts, fakeclock.Now().Sub(start))
+	}
+	g.wg.Wait()
+	if got := ran.Load(); got != 6 {
+		t.Errorf("Expected 6 tasks to run, ran %d", got)
+	}
+
+	// The first two start straight away, then one every half second
+	want := []time.Duration{0, 0, 500 * time.Millisecond, time.Second, 1500 * time.Millisecond, 2 * time.Second}
+	if !slices.Equal(starts, want) {
+		t.Errorf("Expected tasks to start at %v, started at %v", want, starts)
+	}
+	if len(g.errs) != 0 {
+		t.Errorf("Expected no errors, got %v", g.errs)
+	}
+
+	// A failed acquire is reported to the group instead of running the task
+	ctx, cancel := context.WithDeadline(t.Context(), fakeclock.Now().Add(time.Millisecond))
+	defer cancel()
+	l.Go(ctx, g, func() error {
+		t.Errorf("The task should not run after a failed acquire")
+		return nil
+	})
+	g.wg.Wait()
+	if len(g.errs) != 1 || !errors.Is(g.errs[0], context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded to be reported to the group, got %v", g.errs)
+	}
+}
+
+func TestAcquireBlocked(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	l := New(2, time.Second, WithClock(fakeclock))
+	for range 2 {
+		blocked, err := l.AcquireBlocked(t.Context())
+		if err != nil {
+			t.Fatalf("Unexpected error on AcquireBlocked() - %s", err)
+		}
+		if blocked {
+			t.Errorf("Expected an immediate grant not to report blocking")
+		}
+	}
+
+	blocked, err := l.AcquireBlocked(t.Context())
+	if err != nil {
+		t.Fatalf("Unexpected error on AcquireBlocked() - %s", err)
+	}
+	if !blocked {
+		t.Errorf("Expected AcquireBlocked() to report blocking on an empty bucket")
+	}
+}
+
+func TestRefillConverges(t *testing.T) {
+	// Whatever the pattern of calls, the fractional credit carried between
+	// refills means the bucket is credited with exactly rate tokens per window,
+	// with no drift.
+	for seed := range uint64(10) {
+		r := rand.New(rand.NewPCG(seed, 1))
+		fakeclock := newFakeClock(time.Now())
+		start := fakeclock.Now()
+
+		const (
+			rate   = 7
+			window = 3 * time.Second
+		)
+		l := New(rate, window, WithClock(fakeclock))
+		l.Drain()
+
+		var granted int64
+		for range 10000 {
+			fakeclock.Advance(time.Duration(r.Int64N(int64(50 * time.Millisecond))))
+			for l.TryAcquire() {
+				granted++
+			}
+		}
+
+		elapsed := fakeclock.Now().Sub(start)
+		if want := int64(elapsed) * rate / int64(window); granted != want {
+			t.Errorf("Seed %d: expected %d tokens in %s, granted %d", seed, want, elapsed, granted)
+		}
+	}
+}
+
+func TestHugeRateDoesntSpin(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	// Two tokens a nanosecond, so the time per token rounds to zero
+	l := New(2_000_000_000, time.Second, WithBurst(1), WithJitter(1), WithClock(fakeclock))
+	l.random = sequence(0) // jitter the wait all the way down to zero
+	for range 3 {
+		l.Drain()
+		if err := l.Acquire(t.Context()); err != nil {
+			t.Fatalf("Unexpected error on Acquire() - %s", err)
+		}
+	}
+	if fakeclock.afterCount != 3 {
+		t.Errorf("Expected each Acquire() to sleep once, slept %d times", fakeclock.afterCount)
+	}
+	if wait := l.TimeToNext(); wait != time.Nanosecond {
+		t.Errorf("Expected the next token in 1ns, got %s", wait)
+	}
+}
+
+func TestLongIdleDoesntOverflow(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	// elapsed*rate overflows int64 after around nine seconds
+	const rate = 1_000_000_000
+	l := New(rate, time.Second, WithClock(fakeclock))
+	l.Drain()
+	fakeclock.Advance(30 * 24 * time.Hour)
+	if got := l.Tokens(); got != rate {
+		t.Errorf("Expected a full bucket of %d tokens after a long idle period, has %d", rate, got)
+	}
+
+	// Likewise for the wait, with a long window
+	l = New(rate, 24*time.Hour, WithClock(fakeclock))
+	l.Drain()
+	if got, want := l.TimeToNext(), 86400*time.Nanosecond; got != want {
+		t.Errorf("Expected the next token in %s, got %s", want, got)
+	}
+}
+
+func TestMulDiv(t *testing.T) {
+	for _, tc := range []struct {
+		a, b, c, d uint64
+		q, r       uint64
+		ok         bool
+	}{
+		{7, 3, 2, 5, 4, 3, true},
+		{math.MaxUint64, 2, 1, 4, math.MaxUint64 / 2, 3, true},
+		{math.MaxUint64, 2, 0, 2, math.MaxUint64, 0, true},
+		{math.MaxUint64, 3, 0, 2, 0, 0, false},
+	} {
+		q, r, ok := mulDiv(tc.a, tc.b, tc.c, tc.d)
+		if q != tc.q || r != tc.r || ok != tc.ok {
+			t.Errorf("mulDiv(%d, %d, %d, %d) = %d, %d, %t, expected %d, %d, %t", tc.a, tc.b, tc.c, tc.d, q, r, ok, tc.q, tc.r, tc.ok)
+		}
+	}
+}
+
+func TestDebtFloor(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	const burst = 4
+	l := New(burst, time.Second, WithClock(fakeclock))
+
+	// Reservations can drain the bucket and then borrow up to a further burst
+	var reserved int
+	for range 3 * burst {
+		if _, ok := l.Reserve(); ok {
+			reserved++
+		}
+	}
+	if reserved != 2*burst {
+		t.Errorf("Expected %d reservations before hitting the floor, got %d", 2*burst, reserved)
+	}
+	if got := l.Tokens(); got != -burst {
+		t.Errorf("Expected the bucket to be at the floor of %d, has %d", -burst, got)
+	}
+
+	// Recovery time is bounded by the floor, not by how much was asked for
+	if got, want := l.TimeToNext(), time.Duration(burst+1)*time.Second/burst; got != want {
+		t.Errorf("Expected the next token in %s, got %s", want, got)
+	}
+	start := fakeclock.Now()
+	if err := l.Acquire(t.Context()); err != nil {
+		t.Fatalf("Unexpected error on Acquire() - %s", err)
+	}
+	if got, want := fakeclock.Now().Sub(start), 1250*time.Millisecond; got != want {
+		t.Errorf("Expected Acquire() to wait %s, waited %s", want, got)
+	}
+
+	// Restoring a deeper debt is clamped to the floor
+	l.Restore(State{Tokens: -100, LastTime: fakeclock.Now()})
+	if got := l.Tokens(); got != -burst {
+		t.Errorf("Expected a restored debt to be clamped to %d, has %d", -burst, got)
+	}
+}
+
+func TestAcquireNCancelTakesNothing(t *testing.T) {
+	// A slow real clock so that AcquireN is genuinely blocked when canceled,
+	// and no tokens accrue during the test.
+	l := New(10, time.Hour)
+	if got := l.AcquireUpTo(7); got != 7 {
+		t.Fatalf("Expected AcquireUpTo() to take 7 tokens, took %d", got)
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- l.AcquireN(ctx, 10)
+	}()
+	for l.numBlocked.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected AcquireN() to fail with context.Canceled, got %v", err)
+	}
+	if got := l.Tokens(); got != 3 {
+		t.Errorf("Expected the canceled AcquireN() to leave 3 tokens, has %d", got)
+	}
+}
+
+func TestWithNoBurst(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	l := New(10, time.Second, WithClock(fakeclock), WithNoBurst())
+	fakeclock.Advance(time.Hour)
+
+	// Only a single token built up while idle, the rest are paced
+	start := fakeclock.Now()
+	for range 5 {
+		if err := l.Acquire(t.Context()); err != nil {
+			t.Fatalf("Unexpected error on Acquire() - %s", err)
+		}
+	}
+	if got, want := fakeclock.Now().Sub(start), 400*time.Millisecond; got != want {
+		t.Errorf("Expected 5 acquires to take %s, took %s", want, got)
+	}
+	if fakeclock.afterCount != 4 {
+		t.Errorf("Expected all but the first acquire to wait, %d waited", fakeclock.afterCount)
+	}
+}
+
+func TestWithInitialTokens(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	for _, tc := range []struct {
+		initial, want int
+	}{
+		{0, 0},
+		{3, 3},
+		{10, 10},
+		{20, 10}, // capped at the burst
+		{-5, 0},
+	} {
+		l := New(10, time.Second, WithClock(fakeclock), WithInitialTokens(tc.initial))
+		if got := l.Tokens(); got != tc.want {
+			t.Errorf("WithInitialTokens(%d): expected %d tokens, got %d", tc.initial, tc.want, got)
+		}
+	}
+
+	// Refill proceeds as normal from the starting level
+	l := New(10, time.Second, WithClock(fakeclock), WithInitialTokens(2))
+	fakeclock.Advance(500 * time.Millisecond)
+	if got := l.Tokens(); got != 7 {
+		t.Errorf("Expected 7 tokens after half a window, got %d", got)
+	}
+	fakeclock.Advance(time.Second)
+	if got := l.Tokens(); got != 10 {
+		t.Errorf("Expected a full bucket after refilling, got %d", got)
+	}
+
+	// The sliding window counts the missing tokens as used
+	l = New(10, time.Second, WithClock(fakeclock), WithAlgorithm(SlidingWindow), WithInitialTokens(4))
+	if got := l.Tokens(); got != 4 {
+		t.Errorf("Expected a sliding window to start with 4 tokens, got %d", got)
+	}
+	fakeclock.Advance(time.Second)
+	if got := l.Tokens(); got != 10 {
+		t.Errorf("Expected a sliding window to be full a window later, got %d", got)
+	}
+}
+
+func TestAcquireBorrow(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	l := New(10, time.Second, WithClock(fakeclock), WithMaxBorrow(5))
+
+	// Borrowing takes the bucket into debt without waiting
+	if err := l.AcquireBorrow(t.Context(), 15); err != nil {
+		t.Fatalf("Unexpected error on AcquireBorrow() - %s", err)
+	}
+	if fakeclock.afterCalled {
+		t.Errorf("AcquireBorrow() should not have blocked within the borrowing limit")
+	}
+	if got := l.Tokens(); got != -5 {
+		t.Errorf("Expected a debt of 5 tokens, has %d", got)
+	}
+
+	// More than the limit allows has to wait for some of the debt to be repaid
+	start := fakeclock.Now()
+	if err := l.AcquireBorrow(t.Context(), 2); err != nil {
+		t.Fatalf("Unexpected error on AcquireBorrow() - %s", err)
+	}
+	if got, want := fakeclock.Now().Sub(start), 200*time.Millisecond; got != want {
+		t.Errorf("Expected AcquireBorrow() to wait %s, waited %s", want, got)
+	}
+
+	// Ordinary acquires wait for the debt to be repaid at the refill rate
+	start = fakeclock.Now()
+	if err := l.Acquire(t.Context()); err != nil {
+		t.Fatalf("Unexpected error on Acquire() - %s", err)
+	}
+	if got, want := fakeclock.Now().Sub(start), 600*time.Millisecond; got != want {
+		t.Errorf("Expected Acquire() to wait %s for the debt to be repaid, waited %s", want, got)
+	}
+
+	// Beyond what could ever be borrowed fails straight away
+	if err := l.AcquireBorrow(t.Context(), 16); !errors.Is(err, ErrTooManyTokens) {
+		t.Errorf("Expected ErrTooManyTokens, got %v", err)
+	}
+
+	// Without WithMaxBorrow it's the same as AcquireN
+	l = New(10, time.Second, WithClock(fakeclock))
+	if err := l.AcquireBorrow(t.Context(), 11); !errors.Is(err, ErrTooManyTokens) {
+		t.Errorf("Expected ErrTooManyTokens without WithMaxBorrow, got %v", err)
+	}
+}
+
+func TestWithCostFunc(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	cost := func(ctx context.Context) int { return 3 }
+	l := New(9, time.Second, WithCostFunc(cost), WithClock(fakeclock))
+	for want := 6; want >= 0; want -= 3 {
+		if err := l.Acquire(t.Context()); err != nil {
+			t.Fatalf("Unexpected error on Acquire() - %s", err)
+		}
+		if got := l.Tokens(); got != want {
+			t.Errorf("Expected each Acquire() to cost 3 tokens, have %d left", got)
+		}
+	}
+
+	// An explicit cost overrides the function
+	fakeclock.Advance(time.Second)
+	if err := l.AcquireN(t.Context(), 1); err != nil {
+		t.Fatalf("Unexpected error on AcquireN() - %s", err)
+	}
+	if got := l.Tokens(); got != 8 {
+		t.Errorf("Expected AcquireN() to cost 1 token, have %d left", got)
+	}
+
+	// The variants of Acquire use the function too
+	l.Reset()
+	if _, err := l.AcquireTimed(t.Context()); err != nil {
+		t.Fatalf("Unexpected error on AcquireTimed() - %s", err)
+	}
+	if left, err := l.AcquireRemaining(t.Context()); err != nil || left != 3 {
+		t.Errorf("Expected AcquireRemaining() to cost 3 tokens, have %d left (%v)", left, err)
+	}
+}
+
+func TestWithCost(t *testing.T) {
+	if got := CostFrom(t.Context()); got != 1 {
+		t.Errorf("Expected a default cost of 1, got %d", got)
+	}
+	ctx := WithCost(t.Context(), 4)
+	if got := CostFrom(ctx); got != 4 {
+		t.Errorf("Expected a cost of 4, got %d", got)
+	}
+
+	fakeclock := newFakeClock(time.Now())
+	l := New(10, time.Second, WithClock(fakeclock))
+	if err := l.Acquire(ctx); err != nil {
+		t.Fatalf("Unexpected error on Acquire() - %s", err)
+	}
+	if got := l.Tokens(); got != 6 {
+		t.Errorf("Expected Acquire() to charge the declared cost, have %d tokens", got)
+	}
+
+	// Every method that is like Acquire charges the same
+	acquires := map[string]func(ctx context.Context) error{
+		"AcquireRemaining": func(ctx context.Context) error { _, err := l.AcquireRemaining(ctx); return err },
+		"AcquireWait":      func(ctx context.Context) error { return l.AcquireWait(ctx, time.Minute) },
+		"AcquireTimed":     func(ctx context.Context) error { _, err := l.AcquireTimed(ctx); return err },
+		"AcquireBlocked":   func(ctx context.Context) error { _, err := l.AcquireBlocked(ctx); return err },
+		"AcquirePriority":  func(ctx context.Context) error { return l.AcquirePriority(ctx, 1) },
+		"AcquireWithBackoff": func(ctx context.Context) error {
+			return l.AcquireWithBackoff(ctx, time.Millisecond, time.Second)
+		},
+	}
+	for name, acquire := range acquires {
+		l.Reset()
+		if err := acquire(ctx); err != nil {
+			t.Fatalf("Unexpected error on %s() - %s", name, err)
+		}
+		if got := l.Tokens(); got != 6 {
+			t.Errorf("Expected %s() to charge the declared cost, have %d tokens", name, got)
+		}
+	}
+
+	// A cost that isn't positive is free, even with the bucket in debt, and
+	// never adds tokens
+	acquires["Acquire"] = l.Acquire
+	for _, cost := range []int{0, -3} {
+		for name, acquire := range acquires {
+			l.Reset()
+			l.Penalize(14)
+			fakeclock.afterCalled = false
+			if err := acquire(WithCost(t.Context(), cost)); err != nil {
+				t.Fatalf("Unexpected error on %s() - %s", name, err)
+			}
+			if fakeclock.afterCalled {
+				t.Errorf("Expected %s() with a cost of %d not to block", name, cost)
+			}
+			if got := l.Tokens(); got != -4 {
+				t.Errorf("Expected %s() with a cost of %d to take nothing, have %d tokens", name, cost, got)
+			}
+		}
+	}
+}
+
+func TestAcquireWithBackoff(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	l := New(1, time.Minute, WithClock(fakeclock))
+	l.Drain()
+	if err := l.AcquireWithBackoff(t.Context(), time.Second, 8*time.Second); err != nil {
+		t.Fatalf("Unexpected error on AcquireWithBackoff() - %s", err)
+	}
+
+	// The sleeps double up to the cap until the token arrives after a minute
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}
+	for range 7 {
+		want = append(want, 8*time.Second)
+	}
+	if !slices.Equal(fakeclock.sleeps, want) {
+		t.Errorf("Expected sleeps of %v, got %v", want, fakeclock.sleeps)
+	}
+}
+
+func TestAcquireFloat(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	// Four quarters take as long as a whole token
+	l := New(1, time.Second, WithClock(fakeclock))
+	l.Drain()
+	start := fakeclock.Now()
+	for range 4 {
+		if err := l.AcquireFloat(t.Context(), 0.25); err != nil {
+			t.Fatalf("Unexpected error on AcquireFloat() - %s", err)
+		}
+	}
+	if got := fakeclock.Now().Sub(start); got != time.Second {
+		t.Errorf("Expected four 0.25 acquires to take 1s, took %s", got)
+	}
+
+	l.Drain()
+	start = fakeclock.Now()
+	if err := l.Acquire(t.Context()); err != nil {
+		t.Fatalf("Unexpected error on Acquire() - %s", err)
+	}
+	if got := fakeclock.Now().Sub(start); got != time.Second {
+		t.Errorf("Expected a whole token to take 1s, took %s", got)
+	}
+
+	// Part of a token comes out of a whole one, with the change kept
+	l = New(2, time.Second, WithClock(fakeclock))
+	if err := l.AcquireFloat(t.Context(), 1.5); err != nil {
+		t.Fatalf("Unexpected error on AcquireFloat() - %s", err)
+	}
+	if got := l.Tokens(); got != 0 {
+		t.Errorf("Expected Tokens() to round down to 0, got %d", got)
+	}
+	fakeclock.afterCalled = false
+	if err := l.AcquireFloat(t.Context(), 0.5); err != nil {
+		t.Fatalf("Unexpected error on AcquireFloat() - %s", err)
+	}
+	if fakeclock.afterCalled {
+		t.Errorf("AcquireFloat() should have used the left over half token")
+	}
+
+	if err := l.AcquireFloat(t.Context(), 2.5); !errors.Is(err, ErrTooManyTokens) {
+		t.Errorf("Expected ErrTooManyTokens for more than the burst, got %v", err)
+	}
+}
+
+func TestWithDefaultTimeout(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	l := New(1, time.Minute, WithClock(fakeclock), WithDefaultTimeout(2*time.Second))
+	l.Drain()
+
+	// The next token is too far away for a context without a deadline
+	err := l.Acquire(t.Context())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the default timeout to give up with context.DeadlineExceeded, got %v", err)
+	}
+	if fakeclock.afterCalled {
+		t.Errorf("Acquire() should have given up without waiting")
+	}
+
+	// Tokens arriving within the timeout are waited for
+	fakeclock.Advance(time.Minute - time.Second)
+	if err := l.Acquire(t.Context()); err != nil {
+		t.Fatalf("Unexpected error on Acquire() - %s", err)
+	}
+
+	// The context's own deadline wins, even when it's further away
+	ctx, cancel := context.WithTimeout(t.Context(), time.Hour)
+	defer cancel()
+	start := fakeclock.Now()
+	if err := l.Acquire(ctx); err != nil {
+		t.Fatalf("Unexpected error on Acquire() - %s", err)
+	}
+	if got := fakeclock.Now().Sub(start); got != time.Minute {
+		t.Errorf("Expected Acquire() to wait a minute for the token, waited %s", got)
+	}
+}
+
+func TestWithClockRegression(t *testing.T) {
+	fakeclock := newFakeClock(time.Now().Round(0))
+
+	var regressions []time.Duration
+	var l *Limiter
+	l = New(10, time.Second, WithClock(fakeclock), WithClockRegression(func(by time.Duration) {
+		regressions = append(regressions, by)
+		l.Rate() // no locks are held, so this mustn't deadlock
+	}))
+	l.AcquireUpTo(4)
+
+	fakeclock.Advance(-time.Minute)
+	if got := l.Tokens(); got != 6 {
+		t.Errorf("Expected the clock going backwards not to reduce the tokens, has %d", got)
+	}
+	if len(regressions) != 1 || regressions[0] != time.Minute {
+		t.Errorf("Expected one regression of a minute, got %v", regressions)
+	}
+
+	// Without the clock going backwards there are no more calls
+	fakeclock.Advance(2 * time.Minute)
+	l.Tokens()
+	if len(regressions) != 1 {
+		t.Errorf("Expected no more regressions once the clock caught up, got %v", regressions)
+	}
+}
+
+func TestClockGoingBackwards(t *testing.T) {
+	// The fake clock's times have no monotonic reading, so it behaves like a
+	// wall clock being changed.
+	fakeclock := newFakeClock(time.Now().Round(0))
+
+	l := New(10, time.Second, WithClock(fakeclock))
+	l.Drain()
+	fakeclock.Advance(300 * time.Millisecond)
+	if got := l.Tokens(); got != 3 {
+		t.Fatalf("Expected 3 tokens, has %d", got)
+	}
+
+	// Jump back an hour and then forward again to where the clock was. The
+	// limiter mustn't credit the hour, nor the 300ms, a second time.
+	fakeclock.Advance(-time.Hour)
+	if got := l.Tokens(); got != 3 {
+		t.Errorf("Expected the bucket to be unchanged after the clock went back, has %d", got)
+	}
+	fakeclock.Advance(time.Hour)
+	if got := l.Tokens(); got != 3 {
+		t.Errorf("Expected no tokens for time already credited, has %d", got)
+	}
+
+	// Once past the old time tokens accrue normally
+	fakeclock.Advance(200 * time.Millisecond)
+	if got := l.Tokens(); got != 5 {
+		t.Errorf("Expected 5 tokens, has %d", got)
+	}
+}
+
+func TestReady(t *testing.T) {
+	tc := newTickClock()
+	l := New(10, time.Second, WithClock(tc))
+
+	// Closed straight away while there are tokens
+	select {
+	case <-l.Ready():
+	default:
+		t.Errorf("Ready() should be closed for a full bucket")
+	}
+
+	// An empty bucket is ready once the next token has refilled
+	l.Drain()
+	ready := l.Ready()
+	sleep := <-tc.waits
+	select {
+	case <-ready:
+		t.Fatalf("Ready() should not be closed for an empty bucket")
+	default:
+	}
+	sleep <- tc.Advance(100 * time.Millisecond)
+	select {
+	case <-ready:
+	case <-time.After(time.Second):
+		t.Fatalf("Ready() was not closed after the refill interval")
+	}
+	if !l.TryAcquire() {
+		t.Errorf("TryAcquire() should succeed once Ready() is closed")
+	}
+
+	// Closing the limiter stops the wait without the channel closing
+	ready = l.Ready()
+	<-tc.waits
+	l.Close()
+	select {
+	case <-ready:
+		t.Errorf("Ready() should not be closed for a closed limiter")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestClone(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	l := New(10, time.Second, WithClock(fakeclock), WithBurst(4), WithFairness(FIFO))
+	l.SetRate(20, time.Second)
+	l.Drain()
+
+	c := l.Clone()
+	if c.Rate() != 20 || c.Window() != time.Second || c.burst != 4 || c.fairness != FIFO {
+		t.Errorf("Expected the clone to have the same configuration, got %s with burst %d", c, c.burst)
+	}
+	if c.clock != fakeclock {
+		t.Errorf("Expected the clone to use the same clock")
+	}
+	if got := c.Tokens(); got != 4 {
+		t.Errorf("Expected the clone to start with a full bucket, has %d", got)
+	}
+
+	// The buckets are independent
+	if err := c.AcquireN(t.Context(), 3); err != nil {
+		t.Fatalf("Unexpected error on AcquireN() - %s", err)
+	}
+	fakeclock.Advance(50 * time.Millisecond)
+	if got := l.Tokens(); got != 1 {
+		t.Errorf("Expected acquiring from the clone not to affect the original, has %d", got)
+	}
+	if got := c.Tokens(); got != 2 {
+		t.Errorf("Expected the clone to have 2 tokens, has %d", got)
+	}
+}
+
+func TestLimiterCopiesAreVetted(t *testing.T) {
+	// go vet's copylocks check reports copies of structs that hold a lock by
+	// value, so Limiter must keep holding one.
+	typ := reflect.TypeFor[Limiter]()
+	locker := reflect.TypeFor[sync.Locker]()
+	for i := range typ.NumField() {
+		if reflect.PointerTo(typ.Field(i).Type).Implements(locker) {
+			return
+		}
+	}
+	t.Errorf("Limiter holds no lock by value so go vet won't report copies")
+}
+
+func TestWithMinWait(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	// The next token is a microsecond away, but the sleep is floored
+	l := New(1_000_000, time.Second, WithClock(fakeclock), WithMinWait(time.Millisecond))
+	l.Drain()
+	start := fakeclock.Now()
+	if err := l.Acquire(t.Context()); err != nil {
+		t.Fatalf("Unexpected error on Acquire() - %s", err)
+	}
+	if got := fakeclock.Now().Sub(start); got != time.Millisecond {
+		t.Errorf("Expected Acquire() to sleep for the minimum of 1ms, slept %s", got)
+	}
+
+	// Tokens built up during the sleep are there for the next callers
+	if got := l.Tokens(); got != 999 {
+		t.Errorf("Expected 999 tokens left after the sleep, has %d", got)
+	}
+
+	// Waits longer than the minimum are unaffected
+	l = New(10, time.Second, WithClock(fakeclock), WithMinWait(time.Millisecond))
+	l.Drain()
+	start = fakeclock.Now()
+	if err := l.Acquire(t.Context()); err != nil {
+		t.Fatalf("Unexpected error on Acquire() - %s", err)
+	}
+	if got := fakeclock.Now().Sub(start); got != 100*time.Millisecond {
+		t.Errorf("Expected Acquire() to wait 100ms, waited %s", got)
+	}
+}
+
+func TestWaitFull(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	l := New(10, time.Second, WithClock(fakeclock), WithBurst(5))
+	if err := l.WaitFull(t.Context()); err != nil {
+		t.Fatalf("Unexpected error on WaitFull() - %s", err)
+	}
+	if fakeclock.afterCalled {
+		t.Errorf("WaitFull() should return straight away for a full bucket")
+	}
+
+	l.Drain()
+	start := fakeclock.Now()
+	if err := l.WaitFull(t.Context()); err != nil {
+		t.Fatalf("Unexpected error on WaitFull() - %s", err)
+	}
+	if got, want := fakeclock.Now().Sub(start), 500*time.Millisecond; got != want {
+		t.Errorf("Expected WaitFull() to wait %s, waited %s", want, got)
+	}
+	if fakeclock.afterCount != 1 {
+		t.Errorf("Expected WaitFull() to sleep once rather than poll, slept %d times", fakeclock.afterCount)
+	}
+	if got := l.Tokens(); got != 5 {
+		t.Errorf("Expected a full bucket, has %d", got)
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	l.Drain()
+	if err := l.WaitFull(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
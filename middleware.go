@@ -0,0 +1,46 @@
+package ratelimiter
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// Middleware returns HTTP middleware that rate limits requests with l. Each
+// request waits in Acquire using the request's context, so a request with a
+// deadline or a client that goes away stops waiting. If the wait is abandoned
+// the middleware responds with 429 Too Many Requests and a Retry-After header
+// estimating when a token will be available, and the next handler is not
+// called. Requests cost one token unless middleware earlier in the chain has
+// declared otherwise with WithCost.
+//
+// Every response also carries the RateLimit-Limit, RateLimit-Remaining and
+// RateLimit-Reset headers from the IETF RateLimit header fields draft, so that
+// well behaved clients can pace themselves. They give the limiter's rate, the
+// tokens left and the seconds until the next token respectively.
+func Middleware(l *Limiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			err := l.Acquire(r.Context())
+			reset := setRateLimitHeaders(w.Header(), l)
+			if err != nil {
+				w.Header().Set("Retry-After", strconv.Itoa(max(1, reset)))
+				http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// setRateLimitHeaders sets the RateLimit headers on h from the current state of
+// l and returns the number of seconds until the next token.
+func setRateLimitHeaders(h http.Header, l *Limiter) int {
+	// The headers are in whole seconds, round up so clients don't come back
+	// too early.
+	reset := int(math.Ceil(l.TimeToNext().Seconds()))
+	h.Set("RateLimit-Limit", strconv.Itoa(l.Rate()))
+	h.Set("RateLimit-Remaining", strconv.Itoa(max(0, l.Tokens())))
+	h.Set("RateLimit-Reset", strconv.Itoa(reset))
+	return reset
+}
@@ -0,0 +1,107 @@
+package ratelimiter
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMiddleware(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	l := New(3, 10*time.Second, WithClock(fakeclock))
+	var served int
+	h := Middleware(l)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served++
+	}))
+
+	var limited int
+	for range 5 {
+		ctx, cancel := context.WithTimeout(t.Context(), time.Second)
+		r := httptest.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		cancel()
+
+		switch w.Code {
+		case http.StatusOK:
+		case http.StatusTooManyRequests:
+			limited++
+			// The next token is 3.33s away which rounds up to 4s
+			if got := w.Header().Get("Retry-After"); got != "4" {
+				t.Errorf("Expected Retry-After of 4, got %q", got)
+			}
+		default:
+			t.Errorf("Unexpected status code %d", w.Code)
+		}
+	}
+
+	if served != 3 {
+		t.Errorf("Expected 3 requests to be served, got %d", served)
+	}
+	if limited != 2 {
+		t.Errorf("Expected 2 requests to be rate limited, got %d", limited)
+	}
+}
+
+func TestMiddlewareRateLimitHeaders(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	l := New(2, 10*time.Second, WithClock(fakeclock))
+	h := Middleware(l)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, want := range []struct {
+		code                    int
+		limit, remaining, reset string
+	}{
+		{http.StatusOK, "2", "1", "0"},
+		{http.StatusOK, "2", "0", "5"},
+		{http.StatusTooManyRequests, "2", "0", "5"},
+	} {
+		ctx, cancel := context.WithTimeout(t.Context(), time.Second)
+		r := httptest.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		cancel()
+
+		if w.Code != want.code {
+			t.Errorf("Expected status code %d, got %d", want.code, w.Code)
+		}
+		for _, header := range []struct{ name, want string }{
+			{"RateLimit-Limit", want.limit},
+			{"RateLimit-Remaining", want.remaining},
+			{"RateLimit-Reset", want.reset},
+		} {
+			if got := w.Header().Get(header.name); got != header.want {
+				t.Errorf("Expected %s of %q, got %q", header.name, header.want, got)
+			}
+		}
+	}
+}
+
+func TestMiddlewareCost(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	l := New(5, 10*time.Second, WithClock(fakeclock))
+	h := Middleware(l)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// Upstream middleware charges large requests more
+	sized := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(WithCost(r.Context(), 4)))
+		})
+	}
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	sized(h).ServeHTTP(httptest.NewRecorder(), r)
+	if got := l.Tokens(); got != 1 {
+		t.Errorf("Expected the request to cost 4 tokens, have %d left", got)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if got := l.Tokens(); got != 0 {
+		t.Errorf("Expected the request to cost 1 token, have %d left", got)
+	}
+}
@@ -0,0 +1,52 @@
+package ratelimiter
+
+import "time"
+
+// An Observer is notified about the outcome of blocking acquires, e.g. to
+// record metrics. Observers are called without any of the limiter's locks held
+// but may be called concurrently from multiple goroutines.
+type Observer interface {
+	// OnAcquire is called when tokens are granted, with the total time spent
+	// waiting for them.
+	OnAcquire(waited time.Duration)
+
+	// OnBlocked is called when an acquire can't be granted immediately and
+	// has to wait. It is called at most once per acquire.
+	OnBlocked()
+
+	// OnCancelled is called when an acquire gives up because its context was
+	// canceled or its deadline passed.
+	OnCancelled()
+}
+
+// WithObserver sets an Observer to be notified about acquires.
+func WithObserver(o Observer) Option {
+	return func(l *Limiter) {
+		l.observer = o
+	}
+}
+
+// WithLogger sets a function to be called with debug events about blocking
+// acquires, each with key-value pairs of context in the style of log/slog, e.g.
+// to wire it to slog.Logger.Debug. The events are:
+//
+//   - "blocked" when an acquire has to wait, with "tokens" wanted
+//   - "granted" when tokens are granted, with "tokens" and "waited"
+//   - "cancelled" when an acquire gives up, with "tokens" and "waited"
+//   - "over-limit" when WithBestEffort lets an acquire through without
+//     tokens, with "tokens"
+//
+// Like an Observer, fn is called without any of the limiter's locks held but
+// may be called concurrently.
+func WithLogger(fn func(event string, kv ...any)) Option {
+	return func(l *Limiter) {
+		l.logger = fn
+	}
+}
+
+// emit passes event to the logger, if there is one.
+func (l *Limiter) emit(event string, kv ...any) {
+	if l.logger != nil {
+		l.logger(event, kv...)
+	}
+}
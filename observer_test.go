@@ -0,0 +1,148 @@
+package ratelimiter
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingObserver struct {
+	mu        sync.Mutex
+	waits     []time.Duration
+	blocked   int
+	cancelled int
+}
+
+func (ro *recordingObserver) OnAcquire(waited time.Duration) {
+	ro.mu.Lock()
+	defer ro.mu.Unlock()
+	ro.waits = append(ro.waits, waited)
+}
+
+func (ro *recordingObserver) OnBlocked() {
+	ro.mu.Lock()
+	defer ro.mu.Unlock()
+	ro.blocked++
+}
+
+func (ro *recordingObserver) OnCancelled() {
+	ro.mu.Lock()
+	defer ro.mu.Unlock()
+	ro.cancelled++
+}
+
+func TestObserver(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+	ro := &recordingObserver{}
+
+	l := New(2, time.Second, WithObserver(ro), WithClock(fakeclock))
+	for range 2 {
+		if err := l.Acquire(t.Context()); err != nil {
+			t.Fatalf("Unexpected error on Acquire() - %s", err)
+		}
+	}
+	if ro.blocked != 0 {
+		t.Errorf("Expected no blocked callbacks, got %d", ro.blocked)
+	}
+
+	// The bucket is empty so these have to wait for a refill
+	if err := l.AcquireN(t.Context(), 2); err != nil {
+		t.Fatalf("Unexpected error on AcquireN() - %s", err)
+	}
+	if ro.blocked != 1 {
+		t.Errorf("Expected 1 blocked callback, got %d", ro.blocked)
+	}
+	if want := []time.Duration{0, 0, time.Second}; !slices.Equal(ro.waits, want) {
+		t.Errorf("Expected waits of %v, got %v", want, ro.waits)
+	}
+
+	// A deadline that is too soon gives up without blocking
+	ctx, cancel := context.WithDeadline(t.Context(), fakeclock.Now().Add(time.Millisecond))
+	defer cancel()
+	if err := l.Acquire(ctx); err == nil {
+		t.Fatalf("Expected Acquire() to fail with a short deadline")
+	}
+	if ro.cancelled != 1 {
+		t.Errorf("Expected 1 cancelled callback, got %d", ro.cancelled)
+	}
+	if len(ro.waits) != 3 {
+		t.Errorf("Expected no acquire callback for a cancelled acquire, got %v", ro.waits)
+	}
+}
+
+func TestWithLogger(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	var (
+		l      *Limiter
+		events []string
+		kvs    [][]any
+	)
+	logger := func(event string, kv ...any) {
+		// The hook must be free to call back into the limiter
+		if !l.mu.TryLock() {
+			t.Errorf("Logger called with the mutex held for %q", event)
+		} else {
+			l.mu.Unlock()
+		}
+		events = append(events, event)
+		kvs = append(kvs, kv)
+	}
+	l = New(2, time.Second, WithLogger(logger), WithClock(fakeclock))
+
+	l.Drain()
+	if err := l.Acquire(t.Context()); err != nil {
+		t.Fatalf("Unexpected error on Acquire() - %s", err)
+	}
+	ctx, cancel := context.WithDeadline(t.Context(), fakeclock.Now().Add(time.Millisecond))
+	defer cancel()
+	if err := l.Acquire(ctx); err == nil {
+		t.Fatalf("Expected Acquire() to fail with a short deadline")
+	}
+
+	if want := []string{"blocked", "granted", "cancelled"}; !slices.Equal(events, want) {
+		t.Fatalf("Expected events %v, got %v", want, events)
+	}
+	if want := []any{"tokens", 1}; !slices.Equal(kvs[0], want) {
+		t.Errorf("Expected blocked to log %v, got %v", want, kvs[0])
+	}
+	if want := []any{"tokens", 1, "waited", 500 * time.Millisecond}; !slices.Equal(kvs[1], want) {
+		t.Errorf("Expected granted to log %v, got %v", want, kvs[1])
+	}
+	if kvs[2][0] != "tokens" || kvs[2][2] != "waited" {
+		t.Errorf("Expected cancelled to log tokens and waited, got %v", kvs[2])
+	}
+}
+
+func TestWithStateChange(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	var changes []bool
+	l := New(2, time.Second, WithStateChange(func(exhausted bool) {
+		changes = append(changes, exhausted)
+	}), WithClock(fakeclock))
+
+	for range 2 {
+		if !l.TryAcquire() {
+			t.Fatalf("TryAcquire() should succeed on a full bucket")
+		}
+	}
+	if !slices.Equal(changes, []bool{true}) {
+		t.Errorf("Expected an exhausted callback once drained, got %v", changes)
+	}
+
+	// Still empty, so no change
+	l.TryAcquire()
+	if len(changes) != 1 {
+		t.Errorf("Expected no callback while still exhausted, got %v", changes)
+	}
+
+	// Noticed as soon as the bucket is next looked at
+	fakeclock.Advance(500 * time.Millisecond)
+	l.Tokens()
+	if !slices.Equal(changes, []bool{true, false}) {
+		t.Errorf("Expected a recovered callback after refilling, got %v", changes)
+	}
+}
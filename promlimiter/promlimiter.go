@@ -0,0 +1,97 @@
+// Package promlimiter exports metrics about a ratelimiter.Limiter to
+// Prometheus. The core ratelimiter package doesn't import the Prometheus
+// client, only this package does.
+//
+// Create a Collector, wire it into a limiter with Instrument and register it
+// with a Prometheus registry:
+//
+//	c := promlimiter.NewCollector("api")
+//	l := ratelimiter.New(10, time.Second, c.Instrument())
+//	prometheus.MustRegister(c)
+package promlimiter
+
+import (
+	"time"
+
+	"github.com/chriskillpack/ratelimiter"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector is a prometheus.Collector for a single limiter. It exposes the
+// metrics
+//
+//	<name>_tokens          gauge, tokens currently in the bucket
+//	<name>_acquires_total  counter, acquires that were granted
+//	<name>_blocks_total    counter, acquires that had to wait
+type Collector struct {
+	limiter  *ratelimiter.Limiter
+	tokens   prometheus.GaugeFunc
+	acquires prometheus.Counter
+	blocks   prometheus.Counter
+}
+
+var (
+	_ prometheus.Collector = (*Collector)(nil)
+	_ ratelimiter.Observer = (*Collector)(nil)
+)
+
+// NewCollector creates a Collector whose metrics are prefixed with name. It
+// reports nothing useful until it has been passed to a limiter with Instrument.
+func NewCollector(name string) *Collector {
+	c := &Collector{
+		acquires: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: name + "_acquires_total",
+			Help: "Total number of acquires that were granted.",
+		}),
+		blocks: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: name + "_blocks_total",
+			Help: "Total number of acquires that had to wait for tokens.",
+		}),
+	}
+	c.tokens = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: name + "_tokens",
+		Help: "Number of tokens currently in the bucket.",
+	}, func() float64 {
+		if c.limiter == nil {
+			return 0
+		}
+		return float64(c.limiter.Tokens())
+	})
+	return c
+}
+
+// Instrument returns an Option that connects the limiter being created to c.
+// It installs c as the limiter's Observer, replacing any other.
+func (c *Collector) Instrument() ratelimiter.Option {
+	return func(l *ratelimiter.Limiter) {
+		c.limiter = l
+		ratelimiter.WithObserver(c)(l)
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	c.tokens.Describe(ch)
+	c.acquires.Describe(ch)
+	c.blocks.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.tokens.Collect(ch)
+	c.acquires.Collect(ch)
+	c.blocks.Collect(ch)
+}
+
+// OnAcquire implements ratelimiter.Observer.
+func (c *Collector) OnAcquire(waited time.Duration) {
+	c.acquires.Inc()
+}
+
+// OnBlocked implements ratelimiter.Observer.
+func (c *Collector) OnBlocked() {
+	c.blocks.Inc()
+}
+
+// OnCancelled implements ratelimiter.Observer.
+func (c *Collector) OnCancelled() {}
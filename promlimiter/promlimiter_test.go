@@ -0,0 +1,50 @@
+package promlimiter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chriskillpack/ratelimiter/ratelimitertest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCollector(t *testing.T) {
+	c := NewCollector("test")
+	clock := ratelimitertest.NewFakeClock(time.Now())
+	l := ratelimitertest.NewWithClock(3, time.Second, clock, c.Instrument())
+
+	// Drain the bucket, then make one more acquire that has to wait
+	for range 3 {
+		if err := l.Acquire(t.Context()); err != nil {
+			t.Fatalf("Unexpected error on Acquire() - %s", err)
+		}
+	}
+	wait := l.TimeToNext()
+	done := make(chan error)
+	go func() { done <- l.Acquire(t.Context()) }()
+	clock.BlockUntil(1)
+	clock.Advance(wait)
+	if err := <-done; err != nil {
+		t.Fatalf("Unexpected error on Acquire() - %s", err)
+	}
+
+	if got := testutil.ToFloat64(c.acquires); got != 4 {
+		t.Errorf("Expected 4 acquires, got %v", got)
+	}
+	if got := testutil.ToFloat64(c.blocks); got != 1 {
+		t.Errorf("Expected 1 block, got %v", got)
+	}
+	if got := testutil.ToFloat64(c.tokens); got != 0 {
+		t.Errorf("Expected 0 tokens, got %v", got)
+	}
+
+	// The collector registers and gathers cleanly
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(c); err != nil {
+		t.Fatalf("Unexpected error registering collector - %s", err)
+	}
+	if n, err := testutil.GatherAndCount(reg); err != nil || n != 3 {
+		t.Errorf("Expected to gather 3 metrics, got %d (err %v)", n, err)
+	}
+}
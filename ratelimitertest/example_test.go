@@ -0,0 +1,31 @@
+package ratelimitertest_test
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/chriskillpack/ratelimiter/ratelimitertest"
+)
+
+func Example() {
+	clock := ratelimitertest.NewFakeClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	l := ratelimitertest.NewWithClock(1, time.Minute, clock)
+	l.Acquire(context.Background())
+
+	// The bucket is empty so the next Acquire blocks until the clock moves
+	done := make(chan struct{})
+	go func() {
+		l.Acquire(context.Background())
+		fmt.Println("acquired at", clock.Now().Format(time.Kitchen))
+		close(done)
+	}()
+	clock.BlockUntil(1)
+	fmt.Println("blocked at", clock.Now().Format(time.Kitchen))
+
+	clock.Advance(time.Minute)
+	<-done
+	// Output:
+	// blocked at 12:00AM
+	// acquired at 12:01AM
+}
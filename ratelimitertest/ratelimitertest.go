@@ -0,0 +1,133 @@
+// Package ratelimitertest provides helpers for testing code that uses rate
+// limiters, chiefly a FakeClock so that tests can control the passage of time
+// rather than waiting for it.
+package ratelimitertest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/chriskillpack/ratelimiter"
+)
+
+// NewWithClock creates a limiter, as ratelimiter.New does, that uses clock.
+func NewWithClock(rate int, window time.Duration, clock ratelimiter.Clock, opts ...ratelimiter.Option) *ratelimiter.Limiter {
+	return ratelimiter.New(rate, window, append([]ratelimiter.Option{ratelimiter.WithClock(clock)}, opts...)...)
+}
+
+// FakeClock is a ratelimiter.Clock whose time only moves when Advance is
+// called. Callers blocked in Acquire stay blocked until the clock has been
+// advanced far enough for them to wake. It is safe for concurrent use.
+type FakeClock struct {
+	mu     sync.Mutex
+	cond   *sync.Cond // signaled when a timer is added
+	now    time.Time
+	timers []*fakeTimer
+}
+
+var _ ratelimiter.TimerClock = (*FakeClock)(nil)
+
+// NewFakeClock returns a FakeClock set to now.
+func NewFakeClock(now time.Time) *FakeClock {
+	fc := &FakeClock{now: now}
+	fc.cond = sync.NewCond(&fc.mu)
+	return fc
+}
+
+// Now returns the clock's current time.
+func (fc *FakeClock) Now() time.Time {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	return fc.now
+}
+
+// After returns a channel that receives the time once the clock has been
+// advanced by at least d.
+func (fc *FakeClock) After(d time.Duration) <-chan time.Time {
+	return fc.NewTimer(d).C()
+}
+
+// NewTimer returns a timer that fires once the clock has been advanced by at
+// least d.
+func (fc *FakeClock) NewTimer(d time.Duration) ratelimiter.Timer {
+	t := &fakeTimer{fc: fc, c: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+// Advance moves the clock forward by d, firing any timers that are due, and
+// returns the new time.
+func (fc *FakeClock) Advance(d time.Duration) time.Time {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	fc.now = fc.now.Add(d)
+	timers := fc.timers[:0]
+	for _, t := range fc.timers {
+		if t.when.After(fc.now) {
+			timers = append(timers, t)
+			continue
+		}
+		t.c <- fc.now
+	}
+	fc.timers = timers
+	return fc.now
+}
+
+// BlockUntil waits until at least n timers are waiting to fire, e.g. so that a
+// test knows a goroutine is blocked in Acquire before advancing the clock.
+func (fc *FakeClock) BlockUntil(n int) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	for len(fc.timers) < n {
+		fc.cond.Wait()
+	}
+}
+
+type fakeTimer struct {
+	fc   *FakeClock
+	c    chan time.Time
+	when time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	active := t.Stop()
+
+	fc := t.fc
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	if d <= 0 {
+		t.c <- fc.now
+		return active
+	}
+	t.when = fc.now.Add(d)
+	fc.timers = append(fc.timers, t)
+	fc.cond.Broadcast()
+	return active
+}
+
+func (t *fakeTimer) Stop() bool {
+	fc := t.fc
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	for i, pending := range fc.timers {
+		if pending == t {
+			fc.timers = append(fc.timers[:i], fc.timers[i+1:]...)
+			return true
+		}
+	}
+	// Discard a time that fired but wasn't received
+	select {
+	case <-t.c:
+	default:
+	}
+	return false
+}
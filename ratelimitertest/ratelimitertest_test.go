@@ -0,0 +1,57 @@
+package ratelimitertest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	fc := NewFakeClock(start)
+
+	c := fc.After(time.Second)
+	fc.Advance(999 * time.Millisecond)
+	select {
+	case <-c:
+		t.Fatalf("After() fired before its time")
+	default:
+	}
+	if got := fc.Advance(time.Millisecond); !got.Equal(start.Add(time.Second)) {
+		t.Errorf("Expected Advance() to return %s, got %s", start.Add(time.Second), got)
+	}
+	select {
+	case <-c:
+	default:
+		t.Fatalf("After() didn't fire once its time came")
+	}
+
+	// Stopped timers don't fire, reset ones fire at the new time
+	timer := fc.NewTimer(time.Second)
+	if !timer.Stop() {
+		t.Errorf("Expected Stop() to report the timer was active")
+	}
+	fc.Advance(time.Hour)
+	timer.Reset(time.Minute)
+	fc.Advance(30 * time.Second)
+	select {
+	case <-timer.C():
+		t.Fatalf("The reset timer fired early")
+	default:
+	}
+	fc.Advance(30 * time.Second)
+	select {
+	case <-timer.C():
+	default:
+		t.Fatalf("The reset timer didn't fire")
+	}
+}
+
+func TestNewWithClock(t *testing.T) {
+	fc := NewFakeClock(time.Now())
+	l := NewWithClock(2, time.Second, fc)
+	l.Drain()
+	fc.Advance(500 * time.Millisecond)
+	if got := l.Tokens(); got != 1 {
+		t.Errorf("Expected the limiter to follow the fake clock, has %d tokens", got)
+	}
+}
@@ -0,0 +1,170 @@
+// Package redislimiter provides a rate limiter whose state lives in Redis, so
+// that it can be shared by many instances of a service. Only this package
+// imports the Redis client, the core ratelimiter package doesn't.
+//
+// The limiter uses the same token bucket algorithm as ratelimiter.Limiter. The
+// refill and consume happen atomically in a Lua script so concurrent instances
+// can never take more tokens than the bucket holds. Time is read from the
+// calling instance's clock, so instances sharing a limiter should have roughly
+// synchronized clocks.
+package redislimiter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/chriskillpack/ratelimiter"
+	"github.com/redis/go-redis/v9"
+)
+
+// The token bucket is stored in a hash with the fields tokens, which may be
+// fractional, and ts, the time of the last refill in microseconds. It returns
+// a pair of whether the tokens were taken and if not how many microseconds
+// until they will be available.
+var script = redis.NewScript(`
+local key = KEYS[1]
+local rate = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local burst = tonumber(ARGV[3])
+local now = tonumber(ARGV[4])
+local n = tonumber(ARGV[5])
+
+local state = redis.call('HMGET', key, 'tokens', 'ts')
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil or ts == nil then
+	tokens = burst
+	ts = now
+end
+
+if now > ts then
+	tokens = math.min(burst, tokens + (now - ts) * rate / window)
+	ts = now
+end
+
+local allowed = 0
+local wait = 0
+if tokens >= n then
+	tokens = tokens - n
+	allowed = 1
+else
+	wait = math.ceil((n - tokens) * window / rate)
+end
+
+redis.call('HSET', key, 'tokens', tostring(tokens), 'ts', tostring(ts))
+-- Once the bucket has refilled the state is no different to a missing key.
+local ttl = math.ceil((burst - tokens) * window / rate / 1000) + 1000
+redis.call('PEXPIRE', key, ttl)
+return {allowed, wait}
+`)
+
+// DistributedLimiter is a token bucket rate limiter backed by Redis.
+type DistributedLimiter struct {
+	client redis.Scripter
+	key    string
+	rate   int
+	window time.Duration
+	burst  int
+	clock  ratelimiter.Clock
+}
+
+// An Option configures a DistributedLimiter, see New.
+type Option func(*DistributedLimiter)
+
+// WithBurst sets the capacity of the bucket. By default it is the same as the
+// rate.
+func WithBurst(burst int) Option {
+	return func(d *DistributedLimiter) {
+		d.burst = burst
+	}
+}
+
+// WithClock sets the clock used to measure the passage of time.
+func WithClock(c ratelimiter.Clock) Option {
+	return func(d *DistributedLimiter) {
+		d.clock = c
+	}
+}
+
+// New creates a limiter allowing rate units of work per window, with the
+// bucket stored under key in Redis. Every DistributedLimiter created with the
+// same key and client configuration shares a bucket.
+func New(client redis.Scripter, key string, rate int, window time.Duration, opts ...Option) *DistributedLimiter {
+	d := &DistributedLimiter{
+		client: client,
+		key:    key,
+		rate:   rate,
+		window: window,
+		burst:  rate,
+		clock:  realClock{},
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// Acquire blocks until a unit of work can proceed, with the same semantics as
+// ratelimiter.Limiter.Acquire. If Redis can't be reached Acquire returns an
+// error rather than letting the work proceed unlimited.
+func (d *DistributedLimiter) Acquire(ctx context.Context) error {
+	for {
+		wait, err := d.take(ctx, 1)
+		if err != nil || wait == 0 {
+			return err
+		}
+
+		// Don't bother waiting if the context will expire before the tokens
+		// arrive.
+		if deadline, ok := ctx.Deadline(); ok && deadline.Sub(d.clock.Now()) < wait {
+			return context.DeadlineExceeded
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-d.clock.After(wait):
+		}
+	}
+}
+
+// TryAcquire takes a token if one is available without blocking. It returns
+// an error if Redis can't be reached.
+func (d *DistributedLimiter) TryAcquire(ctx context.Context) (bool, error) {
+	wait, err := d.take(ctx, 1)
+	return err == nil && wait == 0, err
+}
+
+// take runs the token bucket script, returning zero if n tokens were taken or
+// how long until they will be available.
+func (d *DistributedLimiter) take(ctx context.Context, n int) (time.Duration, error) {
+	if n > d.burst {
+		return 0, ratelimiter.ErrTooManyTokens
+	}
+
+	res, err := script.Run(ctx, d.client, []string{d.key},
+		d.rate, d.window.Microseconds(), d.burst, d.clock.Now().UnixMicro(), n).Int64Slice()
+	if err != nil {
+		return 0, fmt.Errorf("redislimiter: %w", err)
+	}
+	if len(res) != 2 {
+		return 0, errors.New("redislimiter: unexpected response from script")
+	}
+	if res[0] == 1 {
+		return 0, nil
+	}
+	// Being told to wait for nothing would spin, always wait a little.
+	return max(time.Duration(res[1])*time.Microsecond, time.Microsecond), nil
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
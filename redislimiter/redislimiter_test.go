@@ -0,0 +1,99 @@
+package redislimiter
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/chriskillpack/ratelimiter/ratelimitertest"
+	"github.com/redis/go-redis/v9"
+)
+
+func newClient(t *testing.T, mr *miniredis.Miniredis) *redis.Client {
+	c := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestConcurrentInstances(t *testing.T) {
+	mr := miniredis.RunT(t)
+	clock := ratelimitertest.NewFakeClock(time.Now())
+
+	// Two instances of a service sharing a bucket through Redis
+	const rate = 10
+	instances := []*DistributedLimiter{
+		New(newClient(t, mr), "api", rate, time.Minute, WithClock(clock)),
+		New(newClient(t, mr), "api", rate, time.Minute, WithClock(clock)),
+	}
+
+	var (
+		granted atomic.Int32
+		wg      sync.WaitGroup
+	)
+	for _, d := range instances {
+		for range 3 * rate {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ok, err := d.TryAcquire(t.Context())
+				if err != nil {
+					t.Errorf("Unexpected error on TryAcquire() - %s", err)
+				}
+				if ok {
+					granted.Add(1)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	if got := granted.Load(); got != rate {
+		t.Errorf("Expected exactly %d tokens to be granted across instances, got %d", rate, got)
+	}
+}
+
+func TestAcquireWaitsForRefill(t *testing.T) {
+	mr := miniredis.RunT(t)
+	clock := ratelimitertest.NewFakeClock(time.Now())
+
+	a := New(newClient(t, mr), "api", 2, time.Second, WithClock(clock))
+	b := New(newClient(t, mr), "api", 2, time.Second, WithClock(clock))
+	for _, d := range []*DistributedLimiter{a, b} {
+		if err := d.Acquire(t.Context()); err != nil {
+			t.Fatalf("Unexpected error on Acquire() - %s", err)
+		}
+	}
+
+	// The bucket was drained between the two instances so this has to wait
+	// for the next token, 500ms away
+	done := make(chan error, 1)
+	go func() { done <- a.Acquire(t.Context()) }()
+	clock.BlockUntil(1)
+	clock.Advance(499 * time.Millisecond)
+	select {
+	case err := <-done:
+		t.Fatalf("Expected Acquire() to wait 500ms, returned early with %v", err)
+	default:
+	}
+	clock.Advance(time.Millisecond)
+	if err := <-done; err != nil {
+		t.Fatalf("Unexpected error on Acquire() - %s", err)
+	}
+}
+
+func TestRedisUnreachable(t *testing.T) {
+	mr := miniredis.RunT(t)
+	c := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	t.Cleanup(func() { c.Close() })
+	d := New(c, "api", 2, time.Second)
+	mr.Close()
+
+	if err := d.Acquire(t.Context()); err == nil {
+		t.Errorf("Expected an error when Redis is unreachable")
+	}
+	if ok, err := d.TryAcquire(t.Context()); ok || err == nil {
+		t.Errorf("Expected TryAcquire() to fail when Redis is unreachable, got %t, %v", ok, err)
+	}
+}
@@ -0,0 +1,109 @@
+package ratelimiter
+
+import (
+	"slices"
+	"time"
+)
+
+// A Reservation is a claim on tokens that will be available at a known time,
+// made with Limiter.Reservation. Unlike the reservations made by Reserve and
+// ReserveN it can be canceled, returning the tokens, if the work doesn't
+// happen after all.
+type Reservation struct {
+	l        *Limiter
+	n        int
+	ready    time.Time
+	canceled bool // protected by l.mu
+	kept     int  // tokens kept back for later reservations once canceled
+}
+
+// Reservation reserves n tokens as ReserveN does, returning false in the same
+// cases.
+func (l *Limiter) Reservation(n int) (*Reservation, bool) {
+	l.lock()
+	defer l.unlock()
+
+	if n <= 0 {
+		return &Reservation{l: l, n: n, ready: l.clock.Now()}, true
+	}
+	wait, ok := l.reserve(n)
+	if !ok {
+		return nil, false
+	}
+	r := &Reservation{l: l, n: n, ready: l.lastTime.Add(wait)}
+	l.release()
+	l.holds = append(l.holds, r)
+	return r, true
+}
+
+// Ready returns the time at which the reserved tokens are available.
+func (r *Reservation) Ready() time.Time {
+	return r.ready
+}
+
+// Delay returns how long until the reserved tokens are available, zero if they
+// already are.
+func (r *Reservation) Delay() time.Duration {
+	return max(r.ready.Sub(r.l.clock.Now()), 0)
+}
+
+// Cancel gives up the reservation, returning its tokens to the bucket so that
+// they aren't wasted. Tokens that later reservations are relying on are kept
+// until those are canceled too, and those of a reservation whose time has
+// already come are kept since they can't be given to anyone else. Canceling a
+// reservation more than once has no effect.
+func (r *Reservation) Cancel() {
+	l := r.l
+	l.lock()
+	defer l.unlock()
+
+	if r.canceled || r.n <= 0 {
+		return
+	}
+	r.canceled = true
+	r.kept = r.n
+	l.release()
+}
+
+// release returns the tokens that canceled reservations no longer need to keep
+// back, and forgets reservations that are done with. l.mu must be held by the
+// caller.
+func (l *Limiter) release() {
+	now := l.clock.Now()
+	l.holds = slices.DeleteFunc(l.holds, func(r *Reservation) bool {
+		return !r.ready.After(now)
+	})
+
+	// Later reservations were made assuming the tokens of earlier ones had
+	// been taken, so a canceled reservation keeps back as many as fall
+	// between it and the latest one still to come.
+	latest := l.reserved
+	for _, r := range l.holds {
+		if !r.canceled && r.ready.After(latest) {
+			latest = r.ready
+		}
+	}
+	restore := 0
+	for _, r := range l.holds {
+		if !r.canceled {
+			continue
+		}
+		keep := 0
+		if latest.After(r.ready) {
+			keep = r.kept
+			n, _, ok := mulDiv(uint64(latest.Sub(r.ready)), uint64(l.rate), 0, uint64(l.window))
+			if ok && n < uint64(r.kept) {
+				keep = int(n)
+			}
+		}
+		restore += r.kept - keep
+		r.kept = keep
+	}
+	l.holds = slices.DeleteFunc(l.holds, func(r *Reservation) bool {
+		return r.canceled && r.kept == 0
+	})
+	if restore > 0 {
+		l.refill()
+		l.tokens = min(l.tokens+restore, l.burst)
+	}
+}
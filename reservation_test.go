@@ -0,0 +1,93 @@
+package ratelimiter
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestReservationCancel(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	l := New(10, time.Second, WithClock(fakeclock))
+	l.Drain()
+	r, ok := l.Reservation(3)
+	if !ok {
+		t.Fatalf("Reservation(3) failed")
+	}
+	if got := r.Delay(); got != 300*time.Millisecond {
+		t.Errorf("Expected the reservation to be ready in 300ms, got %s", got)
+	}
+
+	// Canceling gives the tokens back, less those that refilled meanwhile
+	fakeclock.Advance(100 * time.Millisecond)
+	r.Cancel()
+	if !l.TryAcquire() {
+		t.Errorf("TryAcquire() should succeed once the reservation was canceled")
+	}
+	if got := l.Tokens(); got != 0 {
+		t.Errorf("Expected the bucket to be empty, has %d", got)
+	}
+
+	// Only the first cancel counts
+	r.Cancel()
+	if got := l.Tokens(); got != 0 {
+		t.Errorf("Expected canceling twice to have no effect, has %d", got)
+	}
+}
+
+func TestReservationCancelKeepsLaterReservations(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	l := New(10, time.Second, WithClock(fakeclock))
+	l.Drain()
+	first, _ := l.Reservation(2)
+	second, _ := l.Reservation(1)
+
+	// The second reservation relies on one of the first's tokens
+	first.Cancel()
+	if got := l.Tokens(); got != -2 {
+		t.Errorf("Expected one token to be returned, has %d", got)
+	}
+
+	// Too late to cancel once the tokens are available
+	fakeclock.Advance(time.Second)
+	second.Cancel()
+	if got := l.Tokens(); got != 8 {
+		t.Errorf("Expected canceling a ready reservation to return nothing, has %d", got)
+	}
+	if second.Delay() != 0 {
+		t.Errorf("Expected no delay for a ready reservation, got %s", second.Delay())
+	}
+}
+
+func TestReservationCancelAnyOrder(t *testing.T) {
+	tests := [][]int{
+		{0, 1, 2}, {0, 2, 1}, {1, 0, 2}, {1, 2, 0}, {2, 0, 1}, {2, 1, 0},
+	}
+	for _, order := range tests {
+		t.Run(fmt.Sprint(order), func(t *testing.T) {
+			fakeclock := newFakeClock(time.Now())
+
+			l := New(2, time.Second, WithBurst(4), WithClock(fakeclock))
+			l.Drain()
+			var rs []*Reservation
+			for range 3 {
+				r, ok := l.Reservation(1)
+				if !ok {
+					t.Fatalf("Reservation(1) failed")
+				}
+				rs = append(rs, r)
+			}
+
+			// Once every reservation is canceled all their tokens are back,
+			// whichever order it happens in.
+			for _, i := range order {
+				rs[i].Cancel()
+			}
+			if got := l.Tokens(); got != 0 {
+				t.Errorf("Expected all the tokens to be returned, has %d", got)
+			}
+		})
+	}
+}
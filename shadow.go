@@ -0,0 +1,35 @@
+package ratelimiter
+
+// shadowing is a candidate limiter running in shadow mode, see Shadow.
+type shadowing struct {
+	candidate *Limiter
+	onDiff    func(activeAllowed, shadowAllowed bool)
+}
+
+// Shadow runs candidate in shadow mode alongside l, e.g. to try out a new limit
+// on real traffic before switching to it. l carries on enforcing its own limit
+// but every acquire from l is also taken from candidate, without blocking, and
+// whenever the two disagree onDiff is called with whether each let the work
+// straight through. For the blocking methods, such as Acquire, l is taken to
+// have allowed the work if it didn't have to wait. Only the non-blocking
+// outcome of candidate matters, it is never waited on. onDiff is called
+// without any of l's locks held. A nil candidate stops shadowing.
+func (l *Limiter) Shadow(candidate *Limiter, onDiff func(activeAllowed, shadowAllowed bool)) {
+	if candidate == nil {
+		l.shadow.Store(nil)
+		return
+	}
+	l.shadow.Store(&shadowing{candidate: candidate, onDiff: onDiff})
+}
+
+// mirror takes n tokens from the shadow candidate, if there is one, and reports
+// to onDiff if it disagrees with whether l allowed them.
+func (l *Limiter) mirror(n int, allowed bool) {
+	s := l.shadow.Load()
+	if s == nil {
+		return
+	}
+	if shadowAllowed := s.candidate.TryAcquireN(n); shadowAllowed != allowed && s.onDiff != nil {
+		s.onDiff(allowed, shadowAllowed)
+	}
+}
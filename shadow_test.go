@@ -0,0 +1,52 @@
+package ratelimiter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShadow(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	active := New(5, time.Second, WithClock(fakeclock))
+	candidate := New(2, time.Second, WithClock(fakeclock))
+
+	type diff struct{ active, shadow bool }
+	var diffs []diff
+	active.Shadow(candidate, func(activeAllowed, shadowAllowed bool) {
+		diffs = append(diffs, diff{activeAllowed, shadowAllowed})
+	})
+
+	// The candidate allows the first two, then would have blocked the rest
+	for range 4 {
+		if err := active.Acquire(t.Context()); err != nil {
+			t.Fatalf("Unexpected error on Acquire() - %s", err)
+		}
+	}
+	if fakeclock.afterCalled {
+		t.Errorf("The shadow limiter should never make Acquire() block")
+	}
+	if len(diffs) != 2 || diffs[0] != (diff{true, false}) {
+		t.Errorf("Expected 2 diffs where only the active limiter allowed, got %v", diffs)
+	}
+
+	// The last token is another diff, then both agree the bucket is empty
+	if !active.TryAcquire() {
+		t.Errorf("TryAcquire() should take the last token")
+	}
+	if active.TryAcquire() {
+		t.Errorf("TryAcquire() should fail on an empty bucket")
+	}
+	if len(diffs) != 3 {
+		t.Errorf("Expected one more diff from TryAcquire(), got %v", diffs)
+	}
+
+	active.Shadow(nil, nil)
+	active.Reset()
+	for range 5 {
+		active.TryAcquire()
+	}
+	if len(diffs) != 3 {
+		t.Errorf("Expected no more diffs once shadowing stopped, got %v", diffs)
+	}
+}
@@ -0,0 +1,48 @@
+package ratelimiter
+
+import "time"
+
+// State is a serializable snapshot of a limiter's bucket, see Snapshot.
+type State struct {
+	Tokens   int       `json:"tokens"`
+	LastTime time.Time `json:"last_time"`
+}
+
+// Snapshot returns the current state of the bucket so that it can be persisted,
+// e.g. across a restart, and later passed to Restore.
+func (l *Limiter) Snapshot() State {
+	l.lock()
+	defer l.unlock()
+
+	l.refill()
+	return State{Tokens: l.tokens, LastTime: l.lastTime}
+}
+
+// Restore seeds the bucket from a previously saved State. The bucket refills
+// from s.LastTime as if the limiter had been running all along, so a snapshot
+// taken long ago restores to a full bucket. A LastTime in the future, e.g. from
+// a machine with a skewed clock, is treated as now. Restore has no effect on
+// limiters using the SlidingWindow algorithm.
+func (l *Limiter) Restore(s State) {
+	l.lock()
+	defer l.unlock()
+
+	if l.log != nil {
+		return
+	}
+
+	now := l.clock.Now()
+	l.tokens = max(min(s.Tokens, l.burst), l.floor())
+	l.remainder = 0
+	l.lastTime = now
+
+	// Rebase the snapshot time so that it's no further in the past than it
+	// takes to fill the bucket, anything older would be clamped away anyway.
+	if s.LastTime.Before(now) {
+		l.lastTime = s.LastTime
+		if fill := l.timeUntil(l.burst); now.Sub(s.LastTime) > fill {
+			l.lastTime = now.Add(-fill)
+		}
+	}
+	l.refill()
+}
@@ -0,0 +1,65 @@
+package ratelimiter
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	l := New(10, time.Minute, WithClock(fakeclock))
+	if err := l.AcquireN(t.Context(), 7); err != nil {
+		t.Fatalf("Unexpected error on AcquireN() - %s", err)
+	}
+
+	// Round trip through JSON as a real deployment would
+	b, err := json.Marshal(l.Snapshot())
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling snapshot - %s", err)
+	}
+	var s State
+	if err := json.Unmarshal(b, &s); err != nil {
+		t.Fatalf("Unexpected error unmarshaling snapshot - %s", err)
+	}
+	if s.Tokens != 3 {
+		t.Errorf("Expected snapshot to have 3 tokens, got %d", s.Tokens)
+	}
+
+	// Mutate the limiter then restore the snapshot
+	if err := l.AcquireN(t.Context(), 3); err != nil {
+		t.Fatalf("Unexpected error on AcquireN() - %s", err)
+	}
+	l.Restore(s)
+	if got := l.Tokens(); got != 3 {
+		t.Errorf("Expected 3 tokens after restore, got %d", got)
+	}
+
+	// The restored bucket carries on refilling from the snapshot time
+	fakeclock.Advance(12 * time.Second)
+	if got := l.Tokens(); got != 5 {
+		t.Errorf("Expected 5 tokens after refill, got %d", got)
+	}
+}
+
+func TestRestoreRebasesLastTime(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+	l := New(10, time.Minute, WithClock(fakeclock))
+
+	// A snapshot from long ago restores to a full bucket
+	l.Restore(State{Tokens: 0, LastTime: fakeclock.Now().Add(-1000 * time.Hour)})
+	if got := l.Tokens(); got != 10 {
+		t.Errorf("Expected an old snapshot to restore to a full bucket, has %d tokens", got)
+	}
+	if got, want := l.Snapshot().LastTime, fakeclock.Now(); !got.Equal(want) {
+		t.Errorf("Expected last time to be rebased to %s, got %s", want, got)
+	}
+
+	// A snapshot from the future doesn't stop the bucket from refilling
+	l.Restore(State{Tokens: 0, LastTime: fakeclock.Now().Add(time.Hour)})
+	fakeclock.Advance(6 * time.Second)
+	if got := l.Tokens(); got != 1 {
+		t.Errorf("Expected 1 token after refill, has %d", got)
+	}
+}
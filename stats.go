@@ -0,0 +1,34 @@
+package ratelimiter
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats are running totals of a limiter's blocking acquires, see
+// Limiter.Stats. Non-blocking methods such as TryAcquire aren't counted.
+type Stats struct {
+	Acquires      int64         // acquires that succeeded
+	Blocks        int64         // acquires that had to wait for tokens
+	Cancellations int64         // acquires that gave up because of the context
+	OverLimit     int64         // acquires let through without tokens, see WithBestEffort
+	WaitTime      time.Duration // total time spent waiting by all acquires
+}
+
+// counters accumulates Stats.
+type counters struct {
+	acquires, blocks, cancellations, overLimit atomic.Int64
+	waitTime                                   atomic.Int64 // nanoseconds
+}
+
+// Stats returns totals since the limiter was created, for polling trends
+// without setting up an Observer.
+func (l *Limiter) Stats() Stats {
+	return Stats{
+		Acquires:      l.stats.acquires.Load(),
+		Blocks:        l.stats.blocks.Load(),
+		Cancellations: l.stats.cancellations.Load(),
+		OverLimit:     l.stats.overLimit.Load(),
+		WaitTime:      time.Duration(l.stats.waitTime.Load()),
+	}
+}
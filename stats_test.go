@@ -0,0 +1,91 @@
+package ratelimiter
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	l := New(2, time.Second, WithClock(fakeclock))
+	if got := l.Stats(); got != (Stats{}) {
+		t.Errorf("Expected no stats for a new limiter, got %+v", got)
+	}
+
+	// Two immediate acquires, then one that has to wait
+	for range 3 {
+		if err := l.Acquire(t.Context()); err != nil {
+			t.Fatalf("Unexpected error on Acquire() - %s", err)
+		}
+	}
+
+	// And one that gives up
+	ctx, cancel := context.WithTimeout(t.Context(), time.Millisecond)
+	defer cancel()
+	l.Drain()
+	if err := l.AcquireN(ctx, 2); err == nil {
+		t.Fatalf("Expected AcquireN() to give up")
+	}
+
+	// Non-blocking methods aren't counted
+	fakeclock.Advance(time.Second)
+	l.TryAcquire()
+
+	want := Stats{Acquires: 3, Blocks: 1, Cancellations: 1, WaitTime: 500 * time.Millisecond}
+	if got := l.Stats(); got != want {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+}
+
+func TestWithBestEffort(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	l := New(2, time.Second, WithBestEffort(), WithClock(fakeclock))
+	for range 5 {
+		if err := l.Acquire(t.Context()); err != nil {
+			t.Fatalf("Unexpected error on Acquire() - %s", err)
+		}
+	}
+	if err := l.AcquireN(t.Context(), 10); err != nil {
+		t.Fatalf("Unexpected error on AcquireN() - %s", err)
+	}
+	if fakeclock.afterCalled {
+		t.Errorf("A best effort limiter should never block")
+	}
+
+	// The first two took tokens, the rest were over the limit
+	want := Stats{Acquires: 6, OverLimit: 4}
+	if got := l.Stats(); got != want {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+	if got := l.Tokens(); got != 0 {
+		t.Errorf("Expected over the limit acquires not to go into debt, have %d tokens", got)
+	}
+
+	l.Close()
+	if err := l.Acquire(t.Context()); err != ErrClosed {
+		t.Errorf("Expected ErrClosed from a closed limiter, got %v", err)
+	}
+}
+
+func TestBestEffortInChain(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	soft := New(2, time.Minute, WithBestEffort(), WithClock(fakeclock))
+	soft.Drain()
+	hard := New(2, time.Minute, WithClock(fakeclock))
+	hard.Drain()
+
+	// The soft limiter lets the work through without a token, so there's
+	// nothing to give back when the hard one fails.
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second)
+	defer cancel()
+	if err := Chain(soft, hard).Acquire(ctx); err == nil {
+		t.Fatalf("Expected Acquire() to fail on the empty hard limiter")
+	}
+	if got := soft.Tokens(); got != 0 {
+		t.Errorf("Expected the rollback not to create tokens, have %d", got)
+	}
+}
@@ -0,0 +1,155 @@
+package ratelimiter
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConcurrentTryAcquireAccounting(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	const (
+		rate   = 50
+		window = time.Second
+		span   = 2 * time.Second
+		step   = 3 * time.Millisecond
+	)
+	// Start empty, a full bucket rightly discards credit so would muddy the
+	// accounting below.
+	l := New(rate, window, WithClock(fakeclock))
+	l.Drain()
+
+	var (
+		granted atomic.Int64
+		stop    atomic.Bool
+		wg      sync.WaitGroup
+	)
+	for range 200 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stop.Load() {
+				if l.TryAcquire() {
+					granted.Add(1)
+				}
+				runtime.Gosched()
+			}
+		}()
+	}
+
+	// Step the clock through the span while the goroutines hammer the bucket
+	for elapsed := time.Duration(0); elapsed < span; elapsed += step {
+		fakeclock.Advance(step)
+		time.Sleep(10 * time.Microsecond)
+	}
+	stop.Store(true)
+	wg.Wait()
+
+	// Every token that was ever put in the bucket has either been granted or
+	// is still there, none were created or lost.
+	issued := int64(rate * span / window)
+	if got := granted.Load() + int64(l.Tokens()); got != issued {
+		t.Errorf("Expected granted + remaining tokens to be %d, got %d (granted %d)", issued, got, granted.Load())
+	}
+}
+
+func TestConcurrentAcquireNeverExceedsRate(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+	start := fakeclock.Now()
+
+	const (
+		rate   = 20
+		window = time.Second
+	)
+	l := New(rate, window, WithClock(fakeclock))
+
+	var wg sync.WaitGroup
+	var granted atomic.Int64
+	for range 300 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := l.Acquire(t.Context()); err != nil {
+				t.Errorf("Unexpected error on Acquire() - %s", err)
+				return
+			}
+			granted.Add(1)
+		}()
+	}
+	wg.Wait()
+
+	// The fake clock advances as each waiter sleeps. However far it moved, no
+	// more than rate tokens per window can have been handed out on top of the
+	// initial bucket.
+	elapsed := fakeclock.Now().Sub(start)
+	limit := int64(rate) + int64(elapsed)*rate/int64(window)
+	if got := granted.Load(); got > limit {
+		t.Errorf("Granted %d tokens in %s, the limit is %d", got, elapsed, limit)
+	}
+}
+
+func TestFastPathRespectsBurst(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	const burst = 4
+	l := New(burst, time.Second, WithClock(fakeclock))
+
+	// The first take goes through the lock and lends the rest to the fast path
+	for range 2 {
+		if !l.TryAcquire() {
+			t.Fatalf("TryAcquire() should succeed on a full bucket")
+		}
+	}
+
+	// Long after the bucket would have filled up the tokens it accrued while
+	// lent must still be capped at the burst.
+	fakeclock.Advance(time.Minute)
+	var got int
+	for l.TryAcquire() {
+		got++
+	}
+	if got != burst {
+		t.Errorf("Expected %d tokens from a refilled bucket, got %d", burst, got)
+	}
+
+	// Queued callers need the lock to see every acquisition, so nothing is lent
+	// while they wait.
+	l.Reset()
+	l.TryAcquire()
+	w := l.enqueue(0, 1)
+	if l.fast.Load() != 0 {
+		t.Errorf("Expected no tokens to be lent while a caller is queued")
+	}
+	if l.TryAcquire() {
+		t.Errorf("TryAcquire() should not jump the queue")
+	}
+	l.dequeue(w)
+}
+
+func BenchmarkAcquireParallel(b *testing.B) {
+	// A bucket deep enough that callers never have to wait, so the benchmark
+	// measures the cost of contention rather than of the rate.
+	l := New(1, time.Hour, WithBurst(b.N+1))
+	b.RunParallel(func(pb *testing.PB) {
+		ctx := b.Context()
+		for pb.Next() {
+			if err := l.Acquire(ctx); err != nil {
+				b.Fatalf("Unexpected error on Acquire() - %s", err)
+			}
+		}
+	})
+}
+
+func BenchmarkAcquireBlocking(b *testing.B) {
+	// Every call has to wait a little for its token, exercising the timers.
+	l := New(1_000_000, time.Second, WithBurst(1))
+	b.ReportAllocs()
+	for b.Loop() {
+		if err := l.Acquire(b.Context()); err != nil {
+			b.Fatalf("Unexpected error on Acquire() - %s", err)
+		}
+	}
+}
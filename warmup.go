@@ -0,0 +1,79 @@
+package ratelimiter
+
+import (
+	"math"
+	"time"
+)
+
+// WithWarmup ramps the refill rate up from startRate to the limiter's rate, in
+// tokens per window, over the first d after the limiter is created, e.g. to
+// protect a downstream with cold caches from a stampede. The rate rises
+// linearly, so halfway through the warmup it is midway between the two. The
+// bucket still starts full, combine it with WithInitialTokens to start with
+// fewer. WithWarmup has no effect with the SlidingWindow algorithm.
+func WithWarmup(d time.Duration, startRate int) Option {
+	return func(l *Limiter) {
+		l.warmup = d
+		l.startRate = startRate
+	}
+}
+
+// warming returns how much of the warmup is left at t, along with the rate at
+// t and how fast it is rising, in tokens per window per nanosecond.
+func (l *Limiter) warming(t time.Time) (left time.Duration, rate, slope float64) {
+	left = l.epoch.Add(l.warmup).Sub(t)
+	if l.warmup <= 0 || left <= 0 || l.rate <= 0 {
+		return 0, 0, 0
+	}
+	start := float64(max(min(l.startRate, l.rate), 0))
+	slope = (float64(l.rate) - start) / float64(l.warmup)
+	return left, start + slope*float64(t.Sub(l.epoch)), slope
+}
+
+// warmCredit returns the credit accrued between from and to while the warmup
+// is still under way, in the same units as remainder, along with how much of
+// the period that was.
+func (l *Limiter) warmCredit(from, to time.Time) (credit uint64, warm time.Duration, ok bool) {
+	left, rate, slope := l.warming(from)
+	warm = min(to.Sub(from), left)
+	if warm <= 0 {
+		return 0, 0, true
+	}
+	// The area under the ramp.
+	t := float64(warm)
+	c := rate*t + slope*t*t/2
+	if c >= math.MaxInt64 {
+		return 0, 0, false
+	}
+	return uint64(c), warm, true
+}
+
+// warmTimeUntil returns how long until the bucket will have accrued credit, in
+// the same units as remainder, if the warmup is still under way as of the last
+// refill. l.mu must be held by the caller.
+func (l *Limiter) warmTimeUntil(credit float64) (time.Duration, bool) {
+	left, rate, slope := l.warming(l.lastTime)
+	if left <= 0 {
+		return 0, false
+	}
+
+	// If the warmup ends first the rest accrues at the full rate.
+	tl := float64(left)
+	if ramp := rate*tl + slope*tl*tl/2; credit > ramp {
+		return left + durationCeil((credit-ramp)/float64(l.rate)), true
+	}
+
+	// Otherwise solve rate*t + slope*t²/2 = credit.
+	if slope == 0 {
+		return durationCeil(credit / rate), true
+	}
+	return durationCeil((math.Sqrt(rate*rate+2*slope*credit) - rate) / slope), true
+}
+
+// durationCeil converts ns to a Duration, rounding up.
+func durationCeil(ns float64) time.Duration {
+	if ns >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(math.Ceil(ns))
+}
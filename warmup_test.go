@@ -0,0 +1,53 @@
+package ratelimiter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWithWarmup(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	// Ramps from 10/s to 100/s over 10s, so the rate is 10 + 9t per second
+	l := New(100, time.Second, WithWarmup(10*time.Second, 10), WithInitialTokens(0), WithClock(fakeclock))
+
+	// The first token takes a little less than at the starting rate
+	wait := l.TimeToNext()
+	if wait <= 90*time.Millisecond || wait >= 100*time.Millisecond {
+		t.Errorf("Expected the first token in under 100ms, got %s", wait)
+	}
+	fakeclock.Advance(wait)
+	if !l.TryAcquire() {
+		t.Errorf("TryAcquire() should succeed once TimeToNext() has passed")
+	}
+
+	// Between 4s and 5s the average rate is 50.5/s
+	fakeclock.Advance(4*time.Second - wait)
+	l.Drain()
+	fakeclock.Advance(time.Second)
+	if got := l.Tokens(); got != 50 {
+		t.Errorf("Expected 50 tokens mid warmup, have %d", got)
+	}
+
+	// Straddling the end of the warmup, 9.5s to 10.5s averages 98.875/s
+	fakeclock.Advance(4500 * time.Millisecond)
+	l.Drain()
+	if wait := l.TimeToNext(); wait <= 10*time.Millisecond || wait > 11*time.Millisecond {
+		t.Errorf("Expected the next token in just over 10ms near the end of warmup, got %s", wait)
+	}
+	fakeclock.Advance(time.Second)
+	if got := l.Tokens(); got != 98 {
+		t.Errorf("Expected 98 tokens across the end of warmup, have %d", got)
+	}
+
+	// Afterwards it's the full rate
+	l.Drain()
+	fakeclock.Advance(500 * time.Millisecond)
+	if got := l.Tokens(); got != 50 {
+		t.Errorf("Expected 50 tokens after warmup, have %d", got)
+	}
+	l.Drain()
+	if wait := l.TimeToNext(); wait != 10*time.Millisecond {
+		t.Errorf("Expected a token every 10ms after warmup, got %s", wait)
+	}
+}
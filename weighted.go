@@ -0,0 +1,132 @@
+package ratelimiter
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+)
+
+// ErrUnknownKey is returned by WeightedKeyedLimiter for a key that wasn't
+// given a weight.
+var ErrUnknownKey = errors.New("ratelimiter: unknown key")
+
+// BorrowPolicy configures whether keys of a WeightedKeyedLimiter can use
+// capacity that other keys aren't using.
+type BorrowPolicy int
+
+const (
+	// NoBorrowing keeps every key strictly to its own share. This is the
+	// default.
+	NoBorrowing BorrowPolicy = iota
+
+	// BorrowIdle lets a key that has used up its share borrow from keys that
+	// are idle, those whose buckets are full because they haven't been used
+	// recently. Keys that are busy keep all of their share.
+	BorrowIdle
+
+	// BorrowAny lets a key that has used up its share take any tokens that
+	// other keys have yet to use. This makes the most of the overall rate but
+	// a busy key can eat into the share of a key that is only lightly used.
+	BorrowAny
+)
+
+// WeightedKeyedLimiter splits a single rate between a fixed set of keys, e.g.
+// the tenants of a gateway, in proportion to their weights. Each key has its
+// own Limiter for its share.
+type WeightedKeyedLimiter struct {
+	limiters map[string]*Limiter
+	keys     []string // sorted, so that borrowing is deterministic
+	policy   BorrowPolicy
+}
+
+// NewWeightedKeyed creates a WeightedKeyedLimiter sharing rate tokens per
+// window between the keys of weights, each getting rate*weight/total where
+// total is the sum of the weights. Keys with a weight that isn't positive are
+// ignored. Each key can burst up to its share of a window. The options are
+// applied to every key's limiter, as by New.
+func NewWeightedKeyed(rate int, window time.Duration, weights map[string]int, policy BorrowPolicy, opts ...Option) *WeightedKeyedLimiter {
+	var total int
+	for _, weight := range weights {
+		total += max(weight, 0)
+	}
+
+	w := &WeightedKeyedLimiter{limiters: make(map[string]*Limiter), policy: policy}
+	for key, weight := range weights {
+		if weight <= 0 {
+			continue
+		}
+		// rate*weight per total windows is the exact share, with none lost to
+		// rounding.
+		burst := max(1, (rate*weight+total-1)/total)
+		keyOpts := append([]Option{WithBurst(burst)}, opts...)
+		w.limiters[key] = New(rate*weight, window*time.Duration(total), keyOpts...)
+		w.keys = append(w.keys, key)
+	}
+	slices.Sort(w.keys)
+	return w
+}
+
+// Acquire blocks until work for key can proceed, with the same semantics as
+// Limiter.Acquire, including the cost it charges. If key has used up its share
+// it borrows the tokens from another key, as the BorrowPolicy allows, before
+// waiting for its own. It returns ErrUnknownKey if key has no weight.
+func (w *WeightedKeyedLimiter) Acquire(ctx context.Context, key string) error {
+	l, ok := w.limiters[key]
+	if !ok {
+		return ErrUnknownKey
+	}
+	n := l.costOf(ctx)
+	if l.TryAcquireN(n) || w.borrow(key, n) {
+		return nil
+	}
+	return l.AcquireN(ctx, n)
+}
+
+// TryAcquire is like Acquire but never blocks. It reports whether a token was
+// taken, either from key's share or borrowed, and false for an unknown key.
+func (w *WeightedKeyedLimiter) TryAcquire(key string) bool {
+	l, ok := w.limiters[key]
+	if !ok {
+		return false
+	}
+	return l.TryAcquire() || w.borrow(key, 1)
+}
+
+// Limiter returns the limiter for key's share, or nil if key has no weight.
+func (w *WeightedKeyedLimiter) Limiter(key string) *Limiter {
+	return w.limiters[key]
+}
+
+// borrow takes n tokens for key from another key's share, if the policy allows.
+func (w *WeightedKeyedLimiter) borrow(key string, n int) bool {
+	if w.policy == NoBorrowing {
+		return false
+	}
+	for _, other := range w.keys {
+		if other != key && w.limiters[other].lendTokens(n, w.policy == BorrowIdle) {
+			return true
+		}
+	}
+	return false
+}
+
+// lendTokens takes n tokens on behalf of another limiter, only if the bucket is
+// full when idleOnly is set.
+func (l *Limiter) lendTokens(n int, idleOnly bool) bool {
+	l.lock()
+	defer l.unlock()
+
+	if l.closed || l.draining.Load() || l.head != nil {
+		return false
+	}
+	l.refill()
+	if l.tokens < n || idleOnly && l.tokens < l.burst {
+		return false
+	}
+	l.tokens -= n
+	if l.log != nil {
+		l.log.add(l.lastTime, n)
+	}
+	return true
+}
@@ -0,0 +1,104 @@
+package ratelimiter
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWeightedKeyedShares(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+
+	weights := map[string]int{"gold": 3, "silver": 1}
+	w := NewWeightedKeyed(40, time.Second, weights, NoBorrowing, WithClock(fakeclock))
+	for _, key := range []string{"gold", "silver"} {
+		w.Limiter(key).Drain()
+	}
+	fakeclock.Advance(time.Second)
+
+	// Hammer both keys at once, each gets its share of the second's tokens
+	var (
+		wg      sync.WaitGroup
+		granted = map[string]*atomic.Int64{"gold": {}, "silver": {}}
+	)
+	for range 20 {
+		for key, n := range granted {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range 40 {
+					if w.TryAcquire(key) {
+						n.Add(1)
+					}
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	if got := granted["gold"].Load(); got != 30 {
+		t.Errorf("Expected gold to get 30 tokens, got %d", got)
+	}
+	if got := granted["silver"].Load(); got != 10 {
+		t.Errorf("Expected silver to get 10 tokens, got %d", got)
+	}
+
+	// A share refills at its own rate
+	fakeclock.Advance(100 * time.Millisecond)
+	if got := w.Limiter("silver").Tokens(); got != 1 {
+		t.Errorf("Expected silver to refill a token in 100ms, has %d", got)
+	}
+
+	// The declared cost is charged to the key's share, taking the 3 tokens gold
+	// refilled in those 100ms
+	if err := w.Acquire(WithCost(t.Context(), 3), "gold"); err != nil {
+		t.Fatalf("Unexpected error on Acquire() - %s", err)
+	}
+	if got := w.Limiter("gold").Tokens(); got != 0 {
+		t.Errorf("Expected Acquire() to charge 3 tokens, gold has %d", got)
+	}
+
+	if err := w.Acquire(t.Context(), "bronze"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Expected ErrUnknownKey, got %v", err)
+	}
+}
+
+func TestWeightedKeyedBorrowing(t *testing.T) {
+	fakeclock := newFakeClock(time.Now())
+	weights := map[string]int{"a": 1, "b": 1}
+
+	// Without borrowing an exhausted key is stuck even though the other is idle
+	w := NewWeightedKeyed(4, time.Second, weights, NoBorrowing, WithClock(fakeclock))
+	w.Limiter("a").Drain()
+	if w.TryAcquire("a") {
+		t.Errorf("TryAcquire() should not borrow with NoBorrowing")
+	}
+
+	// Idle borrowing only takes from keys with full buckets
+	w = NewWeightedKeyed(4, time.Second, weights, BorrowIdle, WithClock(fakeclock))
+	w.Limiter("a").Drain()
+	if err := w.Acquire(t.Context(), "a"); err != nil {
+		t.Fatalf("Unexpected error on Acquire() - %s", err)
+	}
+	if fakeclock.afterCalled {
+		t.Errorf("Acquire() should have borrowed rather than waited")
+	}
+	if got := w.Limiter("b").Tokens(); got != 1 {
+		t.Errorf("Expected b to have lent a token, has %d", got)
+	}
+	if w.TryAcquire("a") {
+		t.Errorf("TryAcquire() should not borrow from a key that isn't idle")
+	}
+
+	// Any borrowing takes whatever the other key has left
+	w = NewWeightedKeyed(4, time.Second, weights, BorrowAny, WithClock(fakeclock))
+	w.Limiter("a").Drain()
+	w.Limiter("b").AcquireUpTo(1)
+	if !w.TryAcquire("a") {
+		t.Errorf("TryAcquire() should borrow b's unused token with BorrowAny")
+	}
+	if w.TryAcquire("a") {
+		t.Errorf("TryAcquire() should fail once b has nothing left")
+	}
+}